@@ -2,21 +2,32 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
-	"github.com/riccardotornesello/irapi-go"
 
 	"cloud.google.com/go/pubsub/v2"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/archive"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/cache"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/deadletter"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/drift"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/iracing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ledger"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/worker"
 )
 
 const (
 	requestSubscriptionID = "sub-api-req"
+	requestTopicID        = "api-req"
 	responseTopicID       = "api-res"
+
+	// How often the parked requests that are due are published again
+	releaseInterval = time.Minute
 )
 
 func main() {
@@ -31,43 +42,157 @@ func main() {
 	}
 	defer pubSubClient.Close()
 
-	// Create subscriber and publisher
-	sub := pubSubClient.Subscriber(requestSubscriptionID)
-	pub := pubSubClient.Publisher(responseTopicID)
-
-	// Connect to iRacing
-	iracingClient, err := irapi.NewIRacingPasswordLimitedApiClient(
-		os.Getenv("IRACING_CLIENT_ID"),
-		os.Getenv("IRACING_CLIENT_SECRET"),
-		os.Getenv("IRACING_USERNAME"),
-		os.Getenv("IRACING_PASSWORD"),
-	)
+	// Create subscriber and publisher, draining the higher priority lanes first
+	var lanes []bus.Subscriber
+	for _, priority := range bus.Priorities {
+		lanes = append(lanes, bus.NewPubSubSubscriber(pubSubClient.Subscriber(bus.PriorityLaneID(requestSubscriptionID, priority))))
+	}
+	sub := bus.NewPrioritySubscriber(lanes...)
+	responseEncoding := os.Getenv("RESPONSE_ENCODING")
+	err = bus.CheckEncoding(responseEncoding)
 	if err != nil {
-		log.Fatalf("Error initializing iRacing client: %v", err)
+		log.Fatalf("Invalid RESPONSE_ENCODING: %v", err)
 	}
+	pub := bus.NewEncodingPublisher(bus.NewPubSubPublisher(pubSubClient.Publisher(responseTopicID)), responseEncoding)
 
-	// Parse messages
-	log.Println("Listening for messages...")
-	err = sub.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
-		var msgData bus.ApiRequest
-		err := json.Unmarshal(msg.Data, &msgData)
+	// Publish the deferred requests again to their lane once due
+	requestLanes := make(map[string]bus.Publisher)
+	for _, priority := range bus.Priorities {
+		requestLanes[priority] = bus.NewPubSubPublisher(pubSubClient.Publisher(bus.PriorityLaneID(requestTopicID, priority)))
+	}
+	requestPub := bus.NewPriorityPublisher(requestLanes)
+
+	// Send the iRacing calls to another server, e.g. the fake iRacing API
+	if apiURL := os.Getenv("IRACING_API_URL"); apiURL != "" {
+		err := iracing.RedirectAPI(apiURL)
 		if err != nil {
-			log.Printf("Failed to unmarshal message data: %v", err)
-			msg.Nack()
-			return
+			log.Fatalf("Error redirecting the iRacing API: %v", err)
+		}
+	}
+
+	// Read the iRacing accounts to rotate the calls across
+	accounts, err := iracing.ParseAccounts(os.Getenv("IRACING_ACCOUNTS"), iracing.Credentials{
+		ClientID:     os.Getenv("IRACING_CLIENT_ID"),
+		ClientSecret: os.Getenv("IRACING_CLIENT_SECRET"),
+		Username:     os.Getenv("IRACING_USERNAME"),
+		Password:     os.Getenv("IRACING_PASSWORD"),
+	})
+	if err != nil {
+		log.Fatalf("Error reading iRacing accounts: %v", err)
+	}
+
+	// Open the blob store for oversized responses
+	claimCheckThreshold, _ := strconv.Atoi(os.Getenv("CLAIM_CHECK_THRESHOLD"))
+	claimCheck, err := bus.OpenClaimCheck(ctx, os.Getenv("BLOB_STORE_URI"), claimCheckThreshold)
+	if err != nil {
+		log.Fatalf("Error opening blob store: %v", err)
+	}
+
+	// Open the archive of the raw responses
+	responseArchive, err := archive.Open(ctx, os.Getenv("ARCHIVE_URI"))
+	if err != nil {
+		log.Fatalf("Error opening response archive: %v", err)
+	}
+
+	// Track failed deliveries and fetched requests when a database is available
+	var dlq *deadletter.Queue
+	var requestLedger *ledger.Ledger
+	var driftReport *drift.Report
+	var db *database.DB
+	if dbUri := os.Getenv("MONGODB_URI"); dbUri != "" {
+		db = database.Connect(dbUri, os.Getenv("MONGODB_DATABASE"))
+		defer db.Disconnect()
+
+		deadLetterMaxAttempts, _ := strconv.Atoi(os.Getenv("DEAD_LETTER_MAX_ATTEMPTS"))
+		dlq = deadletter.NewQueue(db, deadLetterMaxAttempts)
+		err = dlq.EnsureIndexes(ctx)
+		if err != nil {
+			log.Fatalf("Error creating dead letter indexes: %v", err)
 		}
 
-		err = iracing.HandleApiRequest(ctx, iracingClient, pub, &msgData)
+		requestLedger = ledger.New(db, iracing.Freshness)
+		err = requestLedger.EnsureIndexes(ctx)
 		if err != nil {
-			log.Printf("Failed to handle API request: %v", err)
-			msg.Nack()
-			return
+			log.Fatalf("Error creating request ledger indexes: %v", err)
 		}
 
-		// Acknowledge the message
-		msg.Ack()
-	})
+		driftReport = drift.NewReport(db)
+		err = driftReport.EnsureIndexes(ctx)
+		if err != nil {
+			log.Fatalf("Error creating schema drift indexes: %v", err)
+		}
+	}
+
+	// Connect to iRacing, every account with its own request budget when a database is available
+	accountPool := iracing.NewPool(accounts, db)
+	err = accountPool.EnsureIndexes(ctx)
+	if err != nil {
+		log.Fatalf("Error creating rate limit indexes: %v", err)
+	}
+
+	err = accountPool.Login()
+	if err != nil {
+		log.Fatalf("Error initializing iRacing client: %v", err)
+	}
+
+	// Cache the responses of the slow-changing endpoints
+	cacheTTLs, err := cache.ParseTTLs(os.Getenv("RESPONSE_CACHE_TTLS"), iracing.EndpointFreshness)
+	if err != nil {
+		log.Fatalf("Invalid response cache TTLs: %v", err)
+	}
+	responseCache, err := cache.Open(ctx, os.Getenv("RESPONSE_CACHE_URI"), db, cacheTTLs)
+	if err != nil {
+		log.Fatalf("Error opening response cache: %v", err)
+	}
+
+	// Keep the chunks downloaded so far next to the oversized responses
+	chunkDownloader := iracing.NewChunkDownloader(nil)
+	if claimCheck != nil {
+		chunkDownloader.Store = claimCheck.Store
+	}
+
+	handler := &iracing.Handler{
+		Accounts:   accountPool,
+		Publisher:  pub,
+		ClaimCheck: claimCheck,
+		Ledger:     requestLedger,
+		Archive:    responseArchive,
+		Chunks:     chunkDownloader,
+		Cache:      responseCache,
+		Drift:      driftReport,
+	}
+
+	// Release the parked requests, Pub/Sub cannot delay their redelivery
+	if requestLedger != nil {
+		go releaseDeferred(ctx, requestLedger, requestPub)
+	}
+
+	// Parse messages
+	log.Println("Listening for messages...")
+	err = worker.ApiPull(ctx, sub, handler, dlq)
 	if err != nil {
 		log.Fatalf("sub.Receive: %v", err)
 	}
 }
+
+// releaseDeferred publishes again the parked requests that are due, every releaseInterval.
+func releaseDeferred(ctx context.Context, requestLedger *ledger.Ledger, pub bus.Publisher) {
+	ticker := time.NewTicker(releaseInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		released, err := worker.ReleaseDeferred(ctx, requestLedger, pub)
+		if released > 0 {
+			log.Printf("Released %d deferred requests", released)
+		}
+		if err != nil {
+			log.Printf("Failed to release deferred requests: %v", err)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	_ "github.com/joho/godotenv/autoload"
+
+	"cloud.google.com/go/pubsub/v2"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/deadletter"
+)
+
+const usage = `Usage: iracing_deadletter <command> [flags] [ids...]
+
+Commands:
+  list     list dead-lettered messages
+  show     print the data and attempt history of messages
+  edit     open the data of a dead message in $EDITOR
+  replay   publish messages back to their topic
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	// Connect to the database
+	db := database.Connect(os.Getenv("MONGODB_URI"), os.Getenv("MONGODB_DATABASE"))
+	defer db.Disconnect()
+
+	dlq := deadletter.NewQueue(db, 0)
+
+	command, args := os.Args[1], os.Args[2:]
+
+	var err error
+	switch command {
+	case "list":
+		err = list(ctx, dlq, args)
+	case "show":
+		err = show(dlq, args)
+	case "edit":
+		err = edit(dlq, args)
+	case "replay":
+		err = replay(ctx, dlq, args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("%s: %v", command, err)
+	}
+}
+
+func list(ctx context.Context, dlq *deadletter.Queue, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	state := fs.String("state", deadletter.StateDead, "state to list, empty for all")
+	limit := fs.Int64("limit", 50, "maximum number of messages")
+	fs.Parse(args)
+
+	docs, err := dlq.List(ctx, *state, *limit)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		lastError := ""
+		if n := len(doc.Status.Attempts); n > 0 {
+			lastError = doc.Status.Attempts[n-1].Error
+		}
+
+		fmt.Printf("%s\t%s\t%s\t%d attempts\t%s\n",
+			doc.Meta.Name,
+			doc.Spec.Type,
+			doc.Status.State,
+			len(doc.Status.Attempts),
+			lastError,
+		)
+	}
+
+	return nil
+}
+
+func show(dlq *deadletter.Queue, ids []string) error {
+	for _, id := range ids {
+		doc, err := dlq.Get(id)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+
+		fmt.Printf("ID:       %s\n", doc.Meta.Name)
+		fmt.Printf("Type:     %s\n", doc.Spec.Type)
+		fmt.Printf("State:    %s\n", doc.Status.State)
+		fmt.Printf("Created:  %s\n", doc.Meta.CreatedAt)
+		fmt.Printf("Attributes: %v\n", doc.Spec.Attributes)
+		fmt.Println("Attempts:")
+		for _, attempt := range doc.Status.Attempts {
+			fmt.Printf("  %s  %s\n", attempt.At, attempt.Error)
+		}
+		fmt.Println("Data:")
+		fmt.Println(prettyJSON(doc.Spec.Data))
+		fmt.Println()
+	}
+
+	return nil
+}
+
+func edit(dlq *deadletter.Queue, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one message id")
+	}
+
+	doc, err := dlq.Get(args[0])
+	if err != nil {
+		return err
+	}
+
+	// A retrying message is still being delivered, a replayed one was already published
+	if doc.Status.State != deadletter.StateDead {
+		return fmt.Errorf("message %s is %s, only dead messages can be edited", doc.Meta.Name, doc.Status.State)
+	}
+
+	tmp, err := os.CreateTemp("", "deadletter-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(prettyJSON(doc.Spec.Data))
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+
+	cmd := exec.Command(editor, tmp.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("editor: %w", err)
+	}
+
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	if !json.Valid(data) {
+		return fmt.Errorf("edited data is not valid JSON, message left unchanged")
+	}
+
+	doc.Spec.Data = strings.TrimSpace(string(data))
+
+	err = dlq.Save(doc)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Updated message %s", doc.Meta.Name)
+	return nil
+}
+
+func replay(ctx context.Context, dlq *deadletter.Queue, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	all := fs.Bool("all", false, "replay every dead message")
+	force := fs.Bool("force", false, "also replay messages that are not dead")
+	requestTopicID := fs.String("request-topic", "api-req", "topic for API requests")
+	responseTopicID := fs.String("response-topic", "api-res", "topic for API responses")
+	fs.Parse(args)
+
+	var docs []deadletter.DeadLetterDoc
+	if *all {
+		var err error
+		docs, err = dlq.List(ctx, deadletter.StateDead, 0)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, id := range fs.Args() {
+			doc, err := dlq.Get(id)
+			if err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+
+			// A retrying message is still being delivered, a replayed one was already published
+			if doc.Status.State != deadletter.StateDead && !*force {
+				return fmt.Errorf("message %s is %s, only dead messages can be replayed without -force", doc.Meta.Name, doc.Status.State)
+			}
+
+			docs = append(docs, *doc)
+		}
+	}
+
+	// Create a Pub/Sub client
+	pubSubClient, err := pubsub.NewClient(ctx, os.Getenv("PROJECT_ID"))
+	if err != nil {
+		return fmt.Errorf("failed to create Pub/Sub client: %w", err)
+	}
+	defer pubSubClient.Close()
+
+	requestLanes := make(map[string]bus.Publisher)
+	for _, priority := range bus.Priorities {
+		requestLanes[priority] = bus.NewPubSubPublisher(pubSubClient.Publisher(bus.PriorityLaneID(*requestTopicID, priority)))
+	}
+
+	publishers := map[string]bus.Publisher{
+		deadletter.TypeApiRequest:  bus.NewPriorityPublisher(requestLanes),
+		deadletter.TypeApiResponse: bus.NewPubSubPublisher(pubSubClient.Publisher(*responseTopicID)),
+	}
+
+	for i := range docs {
+		doc := &docs[i]
+
+		pub, ok := publishers[doc.Spec.Type]
+		if !ok {
+			log.Printf("Skipping message %s of unknown type %s", doc.Meta.Name, doc.Spec.Type)
+			continue
+		}
+
+		data := []byte(doc.Spec.Data)
+
+		// The request may have failed permanently, it must be fetched again
+		if doc.Spec.Type == deadletter.TypeApiRequest {
+			data, err = forceRefresh(data)
+			if err != nil {
+				return fmt.Errorf("failed to replay message %s: %w", doc.Meta.Name, err)
+			}
+		}
+
+		_, err = pub.Publish(ctx, &bus.Message{
+			Data:       data,
+			Attributes: doc.Spec.Attributes,
+		}).Get(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to replay message %s: %w", doc.Meta.Name, err)
+		}
+
+		doc.Status.State = deadletter.StateReplayed
+		err = dlq.Save(doc)
+		if err != nil {
+			return fmt.Errorf("failed to mark message %s as replayed: %w", doc.Meta.Name, err)
+		}
+
+		log.Printf("Replayed message %s", doc.Meta.Name)
+	}
+
+	return nil
+}
+
+// forceRefresh sets force_refresh on an API request, so it skips the request
+// ledger and the response cache.
+func forceRefresh(data []byte) ([]byte, error) {
+	var apiRequest bus.ApiRequest
+	err := json.Unmarshal(data, &apiRequest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API request: %w", err)
+	}
+
+	apiRequest.ForceRefresh = true
+
+	return json.Marshal(apiRequest)
+}
+
+func prettyJSON(data string) string {
+	var buf bytes.Buffer
+	if json.Indent(&buf, []byte(data), "", "  ") != nil {
+		return data
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/fakeiracing"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8089", "address to listen on")
+	dir := flag.String("fixtures", "", "directory of the fixtures to serve instead of the recorded ones")
+	rateLimit := flag.Int("rate-limit", fakeiracing.DefaultRateLimit, "calls allowed per minute")
+	linkTTL := flag.Duration("link-ttl", fakeiracing.DefaultLinkTTL, "lifetime of the signed links")
+	flag.Parse()
+
+	var fixtures fs.FS
+	if *dir != "" {
+		fixtures = os.DirFS(*dir)
+	}
+
+	handler := fakeiracing.NewHandler(fixtures)
+	handler.RateLimit = *rateLimit
+	handler.LinkTTL = *linkTTL
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	server := &http.Server{
+		Addr:    *addr,
+		Handler: handler,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving the fake iRacing API on http://%s", *addr)
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Fake iRacing API stopped: %v", err)
+	}
+}
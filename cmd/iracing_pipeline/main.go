@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+
+	_ "github.com/joho/godotenv/autoload"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/archive"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/cache"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/deadletter"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/drift"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/fakeiracing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/iracing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ledger"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/processing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/worker"
+)
+
+const (
+	requestTopicID  = "api-req"
+	responseTopicID = "api-res"
+)
+
+func main() {
+	leagueID := flag.Int64("league-id", 0, "league to crawl, all its active seasons unless -season-id is set")
+	seasonID := flag.Int64("season-id", -1, "league season to crawl")
+	subsessionID := flag.Int64("subsession-id", 0, "single subsession to crawl")
+	cars := flag.Bool("cars", false, "crawl the cars and car classes")
+	tracks := flag.Bool("tracks", false, "crawl the tracks and their assets")
+	priority := flag.String("priority", bus.PriorityNormal, "priority lane of the crawl: high, normal or low")
+	fake := flag.Bool("fake", false, "crawl the recorded fixtures of a fake iRacing API instead of iRacing")
+	noRefetch := flag.Bool("no-refetch", false, "do not wait to fetch again the results of the sessions that just finished")
+	flag.Parse()
+
+	// Build the seed requests
+	var seeds []bus.ApiRequest
+
+	if *leagueID > 0 && *seasonID >= 0 {
+		seeds = append(seeds, bus.ApiRequest{
+			Envelope: bus.NewEnvelope(),
+			Endpoint: "/data/league/season_sessions",
+			Params: map[string]string{
+				"league_id":    fmt.Sprintf("%d", *leagueID),
+				"season_id":    fmt.Sprintf("%d", *seasonID),
+				"results_only": "true",
+			},
+		})
+	}
+
+	if *leagueID > 0 && *seasonID < 0 {
+		seeds = append(seeds, bus.ApiRequest{
+			Envelope: bus.NewEnvelope(),
+			Endpoint: "/data/league/get",
+			Params: map[string]string{
+				"league_id": fmt.Sprintf("%d", *leagueID),
+			},
+		})
+	}
+
+	if *subsessionID > 0 {
+		seeds = append(seeds, bus.ApiRequest{
+			Envelope: bus.NewEnvelope(),
+			Endpoint: "/data/results/get",
+			Params: map[string]string{
+				"subsession_id":    fmt.Sprintf("%d", *subsessionID),
+				"include_licenses": "false",
+			},
+		})
+	}
+
+	if *cars {
+		for _, endpoint := range []string{"/data/car/get", "/data/carclass/get"} {
+			seeds = append(seeds, bus.ApiRequest{
+				Envelope: bus.NewEnvelope(),
+				Endpoint: endpoint,
+			})
+		}
+	}
+
+	// The assets are requested once the tracks are stored
+	if *tracks {
+		seeds = append(seeds, bus.ApiRequest{
+			Envelope: bus.NewEnvelope(),
+			Endpoint: "/data/track/get",
+		})
+	}
+
+	if len(seeds) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	dbUri := os.Getenv("MONGODB_URI")
+	dbName := os.Getenv("MONGODB_DATABASE")
+
+	// Send the iRacing calls to another server, e.g. the fake iRacing API
+	apiURL := os.Getenv("IRACING_API_URL")
+	if *fake {
+		fakeServer := fakeiracing.NewServer(nil)
+		defer fakeServer.Close()
+
+		apiURL = fakeServer.URL
+	}
+	if apiURL != "" {
+		err := iracing.RedirectAPI(apiURL)
+		if err != nil {
+			log.Fatalf("Error redirecting the iRacing API: %v", err)
+		}
+	}
+
+	// Read the iRacing accounts to rotate the calls across
+	accounts, err := iracing.ParseAccounts(os.Getenv("IRACING_ACCOUNTS"), iracing.Credentials{
+		ClientID:     os.Getenv("IRACING_CLIENT_ID"),
+		ClientSecret: os.Getenv("IRACING_CLIENT_SECRET"),
+		Username:     os.Getenv("IRACING_USERNAME"),
+		Password:     os.Getenv("IRACING_PASSWORD"),
+	})
+	if err != nil {
+		log.Fatalf("Error reading iRacing accounts: %v", err)
+	}
+	if *fake {
+		accounts = []iracing.Credentials{fakeiracing.Credentials}
+	}
+
+	// Connect to the database
+	db := database.Connect(dbUri, dbName)
+	defer db.Disconnect()
+
+	// Track failed deliveries
+	deadLetterMaxAttempts, _ := strconv.Atoi(os.Getenv("DEAD_LETTER_MAX_ATTEMPTS"))
+	dlq := deadletter.NewQueue(db, deadLetterMaxAttempts)
+	err = dlq.EnsureIndexes(ctx)
+	if err != nil {
+		log.Fatalf("Error creating dead letter indexes: %v", err)
+	}
+
+	// Open the blob store for oversized responses
+	claimCheckThreshold, _ := strconv.Atoi(os.Getenv("CLAIM_CHECK_THRESHOLD"))
+	claimCheck, err := bus.OpenClaimCheck(ctx, os.Getenv("BLOB_STORE_URI"), claimCheckThreshold)
+	if err != nil {
+		log.Fatalf("Error opening blob store: %v", err)
+	}
+
+	// Open the archive of the raw responses
+	responseArchive, err := archive.Open(ctx, os.Getenv("ARCHIVE_URI"))
+	if err != nil {
+		log.Fatalf("Error opening response archive: %v", err)
+	}
+
+	// Track the requests in flight
+	requestLedger := ledger.New(db, iracing.Freshness)
+	err = requestLedger.EnsureIndexes(ctx)
+	if err != nil {
+		log.Fatalf("Error creating request ledger indexes: %v", err)
+	}
+
+	// Report the responses that drift from the iRacing API types
+	driftReport := drift.NewReport(db)
+	err = driftReport.EnsureIndexes(ctx)
+	if err != nil {
+		log.Fatalf("Error creating schema drift indexes: %v", err)
+	}
+
+	// Connect to iRacing, sharing the request budget of every account with the deployed workers
+	accountPool := iracing.NewPool(accounts, db)
+	err = accountPool.EnsureIndexes(ctx)
+	if err != nil {
+		log.Fatalf("Error creating rate limit indexes: %v", err)
+	}
+
+	err = accountPool.Login()
+	if err != nil {
+		log.Fatalf("Error initializing iRacing client: %v", err)
+	}
+
+	// Create the in-memory queues, one per priority lane for the requests
+	memoryBus := bus.NewMemoryBus()
+
+	requestLanes := make(map[string]bus.Publisher)
+	var requestSubs []bus.Subscriber
+	for _, priority := range bus.Priorities {
+		laneID := bus.PriorityLaneID(requestTopicID, priority)
+		requestLanes[priority] = memoryBus.Publisher(laneID)
+		requestSubs = append(requestSubs, memoryBus.Subscriber(laneID))
+	}
+	requestPub := bus.NewPriorityPublisher(requestLanes)
+
+	// Cache the responses of the slow-changing endpoints
+	cacheTTLs, err := cache.ParseTTLs(os.Getenv("RESPONSE_CACHE_TTLS"), iracing.EndpointFreshness)
+	if err != nil {
+		log.Fatalf("Invalid response cache TTLs: %v", err)
+	}
+	responseCache, err := cache.Open(ctx, os.Getenv("RESPONSE_CACHE_URI"), db, cacheTTLs)
+	if err != nil {
+		log.Fatalf("Error opening response cache: %v", err)
+	}
+
+	// Keep the chunks downloaded so far next to the oversized responses
+	chunkDownloader := iracing.NewChunkDownloader(nil)
+	if claimCheck != nil {
+		chunkDownloader.Store = claimCheck.Store
+	}
+
+	handler := &iracing.Handler{
+		Accounts:   accountPool,
+		Publisher:  memoryBus.Publisher(responseTopicID),
+		ClaimCheck: claimCheck,
+		Ledger:     requestLedger,
+		Archive:    responseArchive,
+		Chunks:     chunkDownloader,
+		Cache:      responseCache,
+		Drift:      driftReport,
+	}
+
+	// Request the drivers not refreshed recently
+	driverRefreshWindow, err := processing.ParseRefreshWindow(os.Getenv("DRIVER_REFRESH_WINDOW"))
+	if err != nil {
+		log.Fatalf("Invalid driver refresh window: %v", err)
+	}
+
+	processor := &processing.Processor{
+		DB:         db,
+		Publisher:  requestPub,
+		ClaimCheck: claimCheck,
+		Ledger:     requestLedger,
+		NoRefetch:  *noRefetch,
+
+		DriverRefreshWindow: driverRefreshWindow,
+	}
+
+	for _, seed := range seeds {
+		seed.Priority = bus.NormalizePriority(*priority)
+
+		data, err := json.Marshal(seed)
+		if err != nil {
+			log.Fatalf("Failed to marshal seed request: %v", err)
+		}
+
+		_, err = requestPub.Publish(ctx, &bus.Message{
+			Data: data,
+			Attributes: map[string]string{
+				bus.PriorityAttribute: seed.Priority,
+			},
+		}).Get(ctx)
+		if err != nil {
+			log.Fatalf("Failed to publish seed request: %v", err)
+		}
+	}
+
+	// Run both workers until the crawl tree is drained
+	workersCtx, cancelWorkers := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		err := worker.ApiPull(workersCtx, bus.NewPrioritySubscriber(requestSubs...), handler, dlq)
+		if err != nil {
+			log.Printf("API pull stopped: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		err := worker.ResponsePull(workersCtx, memoryBus.Subscriber(responseTopicID), processor, dlq)
+		if err != nil {
+			log.Printf("Response pull stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Crawling from %d seed requests...", len(seeds))
+	err = memoryBus.WaitIdle(ctx)
+
+	cancelWorkers()
+	wg.Wait()
+
+	if err != nil {
+		log.Fatalf("Pipeline interrupted with %d pending messages: %v", memoryBus.Pending(), err)
+	}
+
+	log.Println("Pipeline drained, exiting")
+}
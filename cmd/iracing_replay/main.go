@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload"
+
+	"cloud.google.com/go/pubsub/v2"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/archive"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/iracing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ledger"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/processing"
+)
+
+// filter selects the responses to replay.
+type filter struct {
+	endpoint string
+	leagueID int64
+	seasonID int64
+	since    time.Time
+	until    time.Time
+}
+
+func main() {
+	archiveUri := flag.String("archive", "", "archive to replay, e.g. file:///some/dir or gs://bucket/prefix")
+	dir := flag.String("dir", "", "directory of exported API responses to replay, as JSON or JSON lines files")
+	endpoint := flag.String("endpoint", "", "only replay the responses of this endpoint")
+	leagueID := flag.Int64("league-id", 0, "only replay the responses of this league")
+	seasonID := flag.Int64("season-id", 0, "only replay the responses of this league season")
+	since := flag.String("since", "", "only replay the responses fetched from this date or RFC 3339 time")
+	until := flag.String("until", "", "only replay the responses fetched before this date or RFC 3339 time")
+	noFanOut := flag.Bool("no-fan-out", false, "store the responses without publishing their follow-up requests")
+	requestTopicID := flag.String("request-topic", "api-req", "topic for the follow-up API requests")
+	flag.Parse()
+
+	if (*archiveUri == "") == (*dir == "") {
+		fmt.Fprintln(os.Stderr, "exactly one of -archive and -dir is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f := filter{
+		endpoint: *endpoint,
+		leagueID: *leagueID,
+		seasonID: *seasonID,
+	}
+
+	var err error
+	f.since, err = parseTime(*since)
+	if err != nil {
+		log.Fatalf("Invalid -since: %v", err)
+	}
+	f.until, err = parseTime(*until)
+	if err != nil {
+		log.Fatalf("Invalid -until: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Connect to the database
+	db := database.Connect(os.Getenv("MONGODB_URI"), os.Getenv("MONGODB_DATABASE"))
+	defer db.Disconnect()
+
+	// Open the blob store for the responses moved out of their message
+	claimCheckThreshold, _ := strconv.Atoi(os.Getenv("CLAIM_CHECK_THRESHOLD"))
+	claimCheck, err := bus.OpenClaimCheck(ctx, os.Getenv("BLOB_STORE_URI"), claimCheckThreshold)
+	if err != nil {
+		log.Fatalf("Error opening blob store: %v", err)
+	}
+
+	// Request the drivers not refreshed recently
+	driverRefreshWindow, err := processing.ParseRefreshWindow(os.Getenv("DRIVER_REFRESH_WINDOW"))
+	if err != nil {
+		log.Fatalf("Invalid driver refresh window: %v", err)
+	}
+
+	processor := &processing.Processor{
+		DB:         db,
+		ClaimCheck: claimCheck,
+		NoFanOut:   *noFanOut,
+
+		DriverRefreshWindow: driverRefreshWindow,
+	}
+
+	// Publish the follow-up requests like the response worker does
+	if !*noFanOut {
+		pubSubClient, err := pubsub.NewClient(ctx, os.Getenv("PROJECT_ID"))
+		if err != nil {
+			log.Fatalf("Failed to create Pub/Sub client: %v", err)
+		}
+		defer pubSubClient.Close()
+
+		lanes := make(map[string]bus.Publisher)
+		for _, priority := range bus.Priorities {
+			lanes[priority] = bus.NewPubSubPublisher(pubSubClient.Publisher(bus.PriorityLaneID(*requestTopicID, priority)))
+		}
+		processor.Publisher = bus.NewPriorityPublisher(lanes)
+		processor.Ledger = ledger.New(db, iracing.Freshness)
+	}
+
+	// Every replayed response belongs to the same crawl
+	r := &replayer{
+		processor:   processor,
+		filter:      f,
+		root:        bus.NewEnvelope(),
+		subsessions: make(map[int64]leagueSeason),
+	}
+	log.Printf("[%s] Replaying responses", r.root)
+
+	if *archiveUri != "" {
+		err = r.replayArchive(ctx, *archiveUri)
+	} else {
+		err = r.replayDir(ctx, *dir)
+	}
+	if err != nil {
+		log.Fatalf("Replay failed: %v", err)
+	}
+
+	log.Printf("[%s] Replayed %d responses, skipped %d, %d failed", r.root, r.replayed, r.skipped, r.failed)
+	if r.failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// parseTime accepts a date or an RFC 3339 time, and returns the zero time for an empty value.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.DateOnly, value)
+	if err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+type replayer struct {
+	processor *processing.Processor
+	filter    filter
+	root      bus.Envelope
+
+	// League season of the subsessions seen so far, to resolve their laps
+	subsessions map[int64]leagueSeason
+
+	replayed int
+	skipped  int
+	failed   int
+}
+
+// leagueSeason identifies a league season, the season is zero for the
+// responses covering every season of a league.
+type leagueSeason struct {
+	leagueID int64
+	seasonID int64
+}
+
+// replayArchive replays the archived responses, oldest first.
+func (r *replayer) replayArchive(ctx context.Context, uri string) error {
+	responseArchive, err := archive.Open(ctx, uri)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+
+	records, err := responseArchive.List(ctx, r.filter.endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to list archive: %w", err)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].FetchedAt.Before(records[j].FetchedAt)
+	})
+
+	for _, record := range records {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !r.filter.matchFetch(record.Endpoint, &record.FetchedAt) {
+			r.skipped++
+			continue
+		}
+
+		response, err := loadRecord(ctx, responseArchive, &record)
+		if err != nil {
+			log.Printf("Failed to load archived response of '%s' fetched at %s: %v", record.Endpoint, record.FetchedAt, err)
+			r.failed++
+			continue
+		}
+
+		r.replay(ctx, response)
+	}
+
+	return nil
+}
+
+// loadRecord rebuilds the API response of an archived call.
+func loadRecord(ctx context.Context, responseArchive *archive.Archive, record *archive.Record) (*bus.ApiResponse, error) {
+	body, err := responseArchive.Get(ctx, record.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	response := &bus.ApiResponse{
+		Endpoint: record.Endpoint,
+		Params:   record.Params,
+		Body:     string(body),
+	}
+
+	if len(record.Chunks) > 0 {
+		var chunkFiles [][]byte
+		for _, digest := range record.Chunks {
+			chunkFile, err := responseArchive.Get(ctx, digest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read chunk: %w", err)
+			}
+			chunkFiles = append(chunkFiles, chunkFile)
+		}
+
+		chunks, err := iracing.MergeChunks(chunkFiles)
+		if err != nil {
+			return nil, err
+		}
+
+		chunksStr := string(chunks)
+		response.Chunks = &chunksStr
+	}
+
+	return response, nil
+}
+
+// replayDir replays the exported responses of every JSON file in dir, in file order.
+func (r *replayer) replayDir(ctx context.Context, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() || !(strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".jsonl")) {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// A file holds one response or a stream of them
+		decoder := json.NewDecoder(file)
+		for {
+			var response bus.ApiResponse
+			err = decoder.Decode(&response)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				log.Printf("Failed to decode %s: %v", path, err)
+				r.failed++
+				return nil
+			}
+
+			if !r.filter.matchFetch(response.Endpoint, response.CreatedAt) {
+				r.skipped++
+				continue
+			}
+
+			r.replay(ctx, &response)
+		}
+	})
+}
+
+// replay processes a single response if it matches the league and season filters.
+func (r *replayer) replay(ctx context.Context, response *bus.ApiResponse) {
+	response.Envelope = r.root.Child()
+
+	// The league and season can be in the payload moved out of the message
+	err := r.processor.ClaimCheck.Resolve(ctx, response)
+	if err != nil {
+		log.Printf("[%s] Failed to resolve API response payload: %v", response.Envelope, err)
+		r.failed++
+		return
+	}
+
+	if !r.matchIDs(response) {
+		r.skipped++
+		return
+	}
+
+	err = r.processor.MultiplexProcessing(ctx, response)
+	if err != nil {
+		log.Printf("[%s] Failed to process '%s' response: %v", response.Envelope, response.Endpoint, err)
+		r.failed++
+		return
+	}
+
+	r.replayed++
+}
+
+// matchFetch checks the endpoint and the fetch time. Responses without a
+// known fetch time never match a date range.
+func (f *filter) matchFetch(endpoint string, fetchedAt *time.Time) bool {
+	if f.endpoint != "" && endpoint != f.endpoint {
+		return false
+	}
+
+	if f.since.IsZero() && f.until.IsZero() {
+		return true
+	}
+	if fetchedAt == nil {
+		return false
+	}
+
+	return (f.since.IsZero() || !fetchedAt.Before(f.since)) && (f.until.IsZero() || fetchedAt.Before(f.until))
+}
+
+// matchIDs checks the league and season of the response. Responses that do
+// not belong to a league never match a league or season filter, and the
+// responses covering every season of a league match any season of it.
+func (r *replayer) matchIDs(response *bus.ApiResponse) bool {
+	if r.filter.leagueID == 0 && r.filter.seasonID == 0 {
+		return true
+	}
+
+	scope, ok := r.leagueSeason(response)
+	if !ok {
+		return false
+	}
+
+	if r.filter.leagueID > 0 && scope.leagueID != r.filter.leagueID {
+		return false
+	}
+
+	if r.filter.seasonID > 0 && scope.seasonID != 0 && scope.seasonID != r.filter.seasonID {
+		return false
+	}
+
+	return true
+}
+
+// leagueSeason resolves the league season of a response, and returns false
+// when the endpoint does not belong to a league or the season is unknown.
+// The season_id of the results is the one of the series, the league season
+// is league_season_id.
+func (r *replayer) leagueSeason(response *bus.ApiResponse) (leagueSeason, bool) {
+	switch response.Endpoint {
+	case "/data/results/get":
+		var results struct {
+			SubsessionID   int64 `json:"subsession_id"`
+			LeagueID       int64 `json:"league_id"`
+			LeagueSeasonID int64 `json:"league_season_id"`
+		}
+		err := json.Unmarshal([]byte(response.Body), &results)
+		if err != nil || results.LeagueID == 0 {
+			return leagueSeason{}, false
+		}
+
+		scope := leagueSeason{leagueID: results.LeagueID, seasonID: results.LeagueSeasonID}
+		r.subsessions[results.SubsessionID] = scope
+		return scope, true
+
+	case "/data/results/lap_data":
+		subsessionID, err := strconv.ParseInt(response.Params["subsession_id"], 10, 64)
+		if err != nil {
+			return leagueSeason{}, false
+		}
+		return r.subsessionLeagueSeason(subsessionID)
+
+	case "/data/league/get", "/data/league/seasons":
+		leagueID, err := strconv.ParseInt(response.Params["league_id"], 10, 64)
+		if err != nil {
+			return leagueSeason{}, false
+		}
+		return leagueSeason{leagueID: leagueID}, true
+
+	case "/data/league/season_sessions", "/data/league/season_standings":
+		leagueID, err := strconv.ParseInt(response.Params["league_id"], 10, 64)
+		if err != nil {
+			return leagueSeason{}, false
+		}
+		seasonID, err := strconv.ParseInt(response.Params["season_id"], 10, 64)
+		if err != nil {
+			return leagueSeason{}, false
+		}
+		return leagueSeason{leagueID: leagueID, seasonID: seasonID}, true
+
+	default:
+		return leagueSeason{}, false
+	}
+}
+
+// subsessionLeagueSeason returns the league season of a subsession, from the
+// results replayed so far or the labels of its stored session document.
+func (r *replayer) subsessionLeagueSeason(subsessionID int64) (leagueSeason, bool) {
+	if scope, ok := r.subsessions[subsessionID]; ok {
+		return scope, scope.leagueID != 0
+	}
+
+	var sessions []struct {
+		Meta database.Meta `bson:"meta"`
+	}
+	err := r.processor.DB.ListByLabels(processing.SessionCollection, processing.SessionKind, map[string]interface{}{
+		"subsession_id": subsessionID,
+	}, &sessions)
+	if err != nil {
+		log.Printf("Failed to look up the session of subsession ID %d: %v", subsessionID, err)
+		return leagueSeason{}, false
+	}
+
+	var scope leagueSeason
+	if len(sessions) > 0 {
+		scope.leagueID, _ = sessions[0].Meta.Labels["league_id"].(int64)
+		scope.seasonID, _ = sessions[0].Meta.Labels["league_season_id"].(int64)
+	}
+
+	// Also remember the subsessions outside of any league, so they are looked up once
+	r.subsessions[subsessionID] = scope
+	return scope, scope.leagueID != 0
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"os"
+	"strconv"
 
 	_ "github.com/joho/godotenv/autoload"
 
 	"cloud.google.com/go/pubsub/v2"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/deadletter"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/iracing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ledger"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/processing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/worker"
 )
 
 const (
@@ -35,33 +39,56 @@ func main() {
 	defer pubSubClient.Close()
 
 	// Create subscriber and publisher
-	sub := pubSubClient.Subscriber(responseSubscriptionID)
-	pub := pubSubClient.Publisher(requestTopicID)
+	sub := bus.NewPubSubSubscriber(pubSubClient.Subscriber(responseSubscriptionID))
+	lanes := make(map[string]bus.Publisher)
+	for _, priority := range bus.Priorities {
+		lanes[priority] = bus.NewPubSubPublisher(pubSubClient.Publisher(bus.PriorityLaneID(requestTopicID, priority)))
+	}
+	pub := bus.NewPriorityPublisher(lanes)
 
 	// Connect to the database
 	db := database.Connect(dbUri, dbName)
 
+	// Track failed deliveries
+	deadLetterMaxAttempts, _ := strconv.Atoi(os.Getenv("DEAD_LETTER_MAX_ATTEMPTS"))
+	dlq := deadletter.NewQueue(db, deadLetterMaxAttempts)
+	err = dlq.EnsureIndexes(ctx)
+	if err != nil {
+		log.Fatalf("Error creating dead letter indexes: %v", err)
+	}
+
+	// Track the requests in flight
+	requestLedger := ledger.New(db, iracing.Freshness)
+	err = requestLedger.EnsureIndexes(ctx)
+	if err != nil {
+		log.Fatalf("Error creating request ledger indexes: %v", err)
+	}
+
+	// Open the blob store for oversized responses
+	claimCheckThreshold, _ := strconv.Atoi(os.Getenv("CLAIM_CHECK_THRESHOLD"))
+	claimCheck, err := bus.OpenClaimCheck(ctx, os.Getenv("BLOB_STORE_URI"), claimCheckThreshold)
+	if err != nil {
+		log.Fatalf("Error opening blob store: %v", err)
+	}
+
+	// Request the drivers not refreshed recently
+	driverRefreshWindow, err := processing.ParseRefreshWindow(os.Getenv("DRIVER_REFRESH_WINDOW"))
+	if err != nil {
+		log.Fatalf("Invalid driver refresh window: %v", err)
+	}
+
+	processor := &processing.Processor{
+		DB:         db,
+		Publisher:  pub,
+		ClaimCheck: claimCheck,
+		Ledger:     requestLedger,
+
+		DriverRefreshWindow: driverRefreshWindow,
+	}
+
 	// Parse messages
 	log.Println("Listening for messages...")
-	err = sub.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
-		var msgData bus.ApiResponse
-		err := json.Unmarshal(msg.Data, &msgData)
-		if err != nil {
-			log.Printf("Failed to unmarshal message data: %v", err)
-			msg.Nack()
-			return
-		}
-
-		err = processing.MultiplexProcessing(db, ctx, pub, &msgData)
-		if err != nil {
-			log.Printf("Failed to process message: %v", err)
-			msg.Nack()
-			return
-		}
-
-		// Acknowledge the message
-		msg.Ack()
-	})
+	err = worker.ResponsePull(ctx, sub, processor, dlq)
 	if err != nil {
 		log.Fatalf("sub.Receive: %v", err)
 	}
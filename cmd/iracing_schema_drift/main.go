@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/drift"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "", "only report the changes of this endpoint")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	// Connect to the database
+	db := database.Connect(os.Getenv("MONGODB_URI"), os.Getenv("MONGODB_DATABASE"))
+	defer db.Disconnect()
+
+	docs, err := drift.NewReport(db).List(ctx, *endpoint)
+	if err != nil {
+		log.Fatalf("Failed to list schema drift: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tCHANGE\tFIELD\tRESPONSES\tFIRST SEEN\tLAST SEEN\tLAST MESSAGE")
+
+	for _, doc := range docs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			doc.Spec.Endpoint,
+			doc.Spec.Change,
+			doc.Spec.Field,
+			doc.Status.Count,
+			doc.Status.FirstSeenAt.Format(time.RFC3339),
+			doc.Status.LastSeenAt.Format(time.RFC3339),
+			doc.Status.LastMessageID,
+		)
+	}
+
+	w.Flush()
+}
@@ -3,22 +3,33 @@ package sharetelemetryiracingscraper
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"strconv"
 
 	"cloud.google.com/go/pubsub/v2"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
-	"github.com/riccardotornesello/irapi-go"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/archive"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/cache"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/deadletter"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/drift"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/iracing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ledger"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/processing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/worker"
 )
 
 type MessagePublishedData struct {
 	Message struct {
-		Data []byte `json:"data"`
+		ID         string            `json:"messageId"`
+		Data       []byte            `json:"data"`
+		Attributes map[string]string `json:"attributes"`
 	} `json:"message"`
 }
 
@@ -28,72 +39,287 @@ var (
 	apiRequestTopicID  = os.Getenv("API_REQUEST_TOPIC_ID")
 	apiResponseTopicID = os.Getenv("API_RESPONSE_TOPIC_ID")
 
+	// Topics of the priority lanes, the normal topic is used when unset
+	apiRequestLaneTopicIDs = map[string]string{
+		bus.PriorityHigh: os.Getenv("API_REQUEST_HIGH_TOPIC_ID"),
+		bus.PriorityLow:  os.Getenv("API_REQUEST_LOW_TOPIC_ID"),
+	}
+
 	dbUri  = os.Getenv("MONGODB_URI")
 	dbName = os.Getenv("MONGODB_DATABASE")
 
-	pubSubClient  *pubsub.Client
-	iracingClient *irapi.IRacingApiClient
-	db            *database.DB
+	blobStoreUri     = os.Getenv("BLOB_STORE_URI")
+	archiveUri       = os.Getenv("ARCHIVE_URI")
+	responseEncoding = os.Getenv("RESPONSE_ENCODING")
+
+	responseCacheUri  = os.Getenv("RESPONSE_CACHE_URI")
+	responseCacheTTLs = os.Getenv("RESPONSE_CACHE_TTLS")
+
+	pubSubClient    *pubsub.Client
+	accountPool     *iracing.Pool
+	db              *database.DB
+	claimCheck      *bus.ClaimCheck
+	responseArchive *archive.Archive
+	responseCache   *cache.Cache
+	dlq             *deadletter.Queue
+	requestLedger   *ledger.Ledger
+	driftReport     *drift.Report
+
+	apiHandler *iracing.Handler
+	processor  *processing.Processor
 )
 
 func init() {
 	var err error
 
+	err = bus.CheckEncoding(responseEncoding)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid RESPONSE_ENCODING: %v", err))
+	}
+
 	// Connect to Pub/Sub
 	pubSubClient, err = pubsub.NewClient(context.Background(), projectID)
 	if err != nil {
 		panic(fmt.Sprintf("pubsub.NewClient: %v", err))
 	}
 
-	// Connect to iRacing
-	iracingClient, err = irapi.NewIRacingPasswordLimitedApiClient(
-		os.Getenv("IRACING_CLIENT_ID"),
-		os.Getenv("IRACING_CLIENT_SECRET"),
-		os.Getenv("IRACING_USERNAME"),
-		os.Getenv("IRACING_PASSWORD"),
-	)
+	// Read the iRacing accounts to rotate the calls across
+	accounts, err := iracing.ParseAccounts(os.Getenv("IRACING_ACCOUNTS"), iracing.Credentials{
+		ClientID:     os.Getenv("IRACING_CLIENT_ID"),
+		ClientSecret: os.Getenv("IRACING_CLIENT_SECRET"),
+		Username:     os.Getenv("IRACING_USERNAME"),
+		Password:     os.Getenv("IRACING_PASSWORD"),
+	})
 	if err != nil {
-		panic(fmt.Sprintf("Error initializing iRacing client: %v", err))
+		panic(fmt.Sprintf("Error reading iRacing accounts: %v", err))
 	}
 
 	// Connect to the database
 	db = database.Connect(dbUri, dbName)
 
+	// Open the blob store for oversized responses
+	claimCheckThreshold, _ := strconv.Atoi(os.Getenv("CLAIM_CHECK_THRESHOLD"))
+	claimCheck, err = bus.OpenClaimCheck(context.Background(), blobStoreUri, claimCheckThreshold)
+	if err != nil {
+		panic(fmt.Sprintf("Error opening blob store: %v", err))
+	}
+
+	// Open the archive of the raw responses
+	responseArchive, err = archive.Open(context.Background(), archiveUri)
+	if err != nil {
+		panic(fmt.Sprintf("Error opening response archive: %v", err))
+	}
+
+	// Track failed deliveries
+	deadLetterMaxAttempts, _ := strconv.Atoi(os.Getenv("DEAD_LETTER_MAX_ATTEMPTS"))
+	dlq = deadletter.NewQueue(db, deadLetterMaxAttempts)
+	err = dlq.EnsureIndexes(context.Background())
+	if err != nil {
+		panic(fmt.Sprintf("Error creating dead letter indexes: %v", err))
+	}
+
+	// Track the requests in flight
+	requestLedger = ledger.New(db, iracing.Freshness)
+	err = requestLedger.EnsureIndexes(context.Background())
+	if err != nil {
+		panic(fmt.Sprintf("Error creating request ledger indexes: %v", err))
+	}
+
+	// Report the responses that drift from the iRacing API types
+	driftReport = drift.NewReport(db)
+	err = driftReport.EnsureIndexes(context.Background())
+	if err != nil {
+		panic(fmt.Sprintf("Error creating schema drift indexes: %v", err))
+	}
+
+	// Connect to iRacing, sharing the request budget of every account between the instances
+	accountPool = iracing.NewPool(accounts, db)
+	err = accountPool.EnsureIndexes(context.Background())
+	if err != nil {
+		panic(fmt.Sprintf("Error creating rate limit indexes: %v", err))
+	}
+
+	err = accountPool.Login()
+	if err != nil {
+		panic(fmt.Sprintf("Error initializing iRacing client: %v", err))
+	}
+
+	// Cache the responses of the slow-changing endpoints
+	cacheTTLs, err := cache.ParseTTLs(responseCacheTTLs, iracing.EndpointFreshness)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid response cache TTLs: %v", err))
+	}
+	responseCache, err = cache.Open(context.Background(), responseCacheUri, db, cacheTTLs)
+	if err != nil {
+		panic(fmt.Sprintf("Error opening response cache: %v", err))
+	}
+
+	// Keep the chunks downloaded so far next to the oversized responses
+	chunkDownloader := iracing.NewChunkDownloader(nil)
+	if claimCheck != nil {
+		chunkDownloader.Store = claimCheck.Store
+	}
+
+	apiHandler = &iracing.Handler{
+		Accounts:   accountPool,
+		Publisher:  bus.NewEncodingPublisher(bus.NewPubSubPublisher(pubSubClient.Publisher(apiResponseTopicID)), responseEncoding),
+		ClaimCheck: claimCheck,
+		Ledger:     requestLedger,
+		Archive:    responseArchive,
+		Chunks:     chunkDownloader,
+		Cache:      responseCache,
+		Drift:      driftReport,
+	}
+
+	requestLanes := make(map[string]bus.Publisher)
+	for _, priority := range bus.Priorities {
+		topicID := apiRequestLaneTopicIDs[priority]
+		if topicID == "" {
+			topicID = apiRequestTopicID
+		}
+		requestLanes[priority] = bus.NewPubSubPublisher(pubSubClient.Publisher(topicID))
+	}
+
+	// Request the drivers not refreshed recently
+	driverRefreshWindow, err := processing.ParseRefreshWindow(os.Getenv("DRIVER_REFRESH_WINDOW"))
+	if err != nil {
+		panic(fmt.Sprintf("Invalid driver refresh window: %v", err))
+	}
+
+	processor = &processing.Processor{
+		DB:         db,
+		Publisher:  bus.NewPriorityPublisher(requestLanes),
+		ClaimCheck: claimCheck,
+		Ledger:     requestLedger,
+
+		DriverRefreshWindow: driverRefreshWindow,
+	}
+
 	// Register Cloud Functions
 	functions.CloudEvent("ApiPull", apiPull)
 	functions.CloudEvent("ResponsePull", responsePull)
+	functions.CloudEvent("ReleaseDeferred", releaseDeferred)
 }
 
+// apiPull handles the requests of every lane, each lane having its own
+// function. The functions run concurrently, so a lower lane is not held back
+// while a higher one has a backlog: the lanes only get a throughput weighted
+// by the concurrency of their function.
 func apiPull(ctx context.Context, e event.Event) error {
+	msg, err := eventMessage(e)
+	if err != nil {
+		return err
+	}
+
+	msgData, err := handleApiRequest(ctx, msg)
+
+	// Pub/Sub cannot delay a redelivery, the deferred requests wait in the ledger
+	if msgData != nil && errors.Is(err, failure.ErrDeferred) {
+		if worker.Park(ctx, requestLedger, msg, msgData, err) {
+			return nil
+		}
+		return err
+	}
+
+	return settle(ctx, deadletter.TypeApiRequest, msg, err)
+}
+
+func responsePull(ctx context.Context, e event.Event) error {
+	msg, err := eventMessage(e)
+	if err != nil {
+		return err
+	}
+
+	err = handleApiResponse(ctx, msg)
+	return settle(ctx, deadletter.TypeApiResponse, msg, err)
+}
+
+// releaseDeferred publishes again the parked requests that are due, it is
+// triggered every minute by Cloud Scheduler.
+func releaseDeferred(ctx context.Context, e event.Event) error {
+	released, err := worker.ReleaseDeferred(ctx, requestLedger, processor.Publisher)
+	if released > 0 {
+		log.Printf("Released %d deferred requests", released)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release deferred requests: %w", err)
+	}
+
+	return nil
+}
+
+func eventMessage(e event.Event) (*bus.Message, error) {
 	var msg MessagePublishedData
 	if err := e.DataAs(&msg); err != nil {
-		return fmt.Errorf("event.DataAs: %w", err)
+		return nil, fmt.Errorf("event.DataAs: %w", err)
+	}
+
+	id := msg.Message.ID
+	if id == "" {
+		id = e.ID()
+	}
+
+	return &bus.Message{
+		ID:         id,
+		Data:       msg.Message.Data,
+		Attributes: msg.Message.Attributes,
+	}, nil
+}
+
+// settle returns nil when the message must be acknowledged, so that Pub/Sub
+// only retries the failures worth retrying.
+func settle(ctx context.Context, msgType string, msg *bus.Message, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("Failed to handle message %s: %v", msg.ID, err)
+
+	if worker.Fail(ctx, dlq, msgType, msg, err) {
+		return nil
+	}
+
+	return err
+}
+
+// handleApiRequest returns the decoded request along with the error of its
+// handling, nil when it could not be decoded.
+func handleApiRequest(ctx context.Context, msg *bus.Message) (*bus.ApiRequest, error) {
+	data, err := bus.DecodeMessageData(msg.Data, msg.Attributes)
+	if err != nil {
+		return nil, failure.Permanent(fmt.Errorf("bus.DecodeMessageData: %w", err))
 	}
 
 	var msgData bus.ApiRequest
-	err := json.Unmarshal(msg.Message.Data, &msgData)
+	err = json.Unmarshal(data, &msgData)
 	if err != nil {
-		return fmt.Errorf("json.Unmarshal: %w", err)
+		return nil, failure.Permanent(fmt.Errorf("json.Unmarshal: %w", err))
 	}
 
-	pub := pubSubClient.Publisher(apiResponseTopicID)
+	err = apiHandler.HandleApiRequest(ctx, &msgData)
+	if err != nil {
+		return &msgData, fmt.Errorf("[%s] %w", msgData.Envelope, err)
+	}
 
-	return iracing.HandleApiRequest(ctx, iracingClient, pub, &msgData)
+	return &msgData, nil
 }
 
-func responsePull(ctx context.Context, e event.Event) error {
-	var msg MessagePublishedData
-	if err := e.DataAs(&msg); err != nil {
-		return fmt.Errorf("event.DataAs: %w", err)
+func handleApiResponse(ctx context.Context, msg *bus.Message) error {
+	data, err := bus.DecodeMessageData(msg.Data, msg.Attributes)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("bus.DecodeMessageData: %w", err))
 	}
 
 	var msgData bus.ApiResponse
-	err := json.Unmarshal(msg.Message.Data, &msgData)
+	err = json.Unmarshal(data, &msgData)
 	if err != nil {
-		return fmt.Errorf("json.Unmarshal: %w", err)
+		return failure.Permanent(fmt.Errorf("json.Unmarshal: %w", err))
 	}
 
-	pub := pubSubClient.Publisher(apiRequestTopicID)
+	err = processor.MultiplexProcessing(ctx, &msgData)
+	if err != nil {
+		return fmt.Errorf("[%s] %w", msgData.Envelope, err)
+	}
 
-	return processing.MultiplexProcessing(db, ctx, pub, &msgData)
+	return nil
 }
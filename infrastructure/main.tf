@@ -14,20 +14,44 @@ provider "google" {
 
 
 locals {
+  // Priority lanes of the API requests besides the normal one. The lanes run
+  // concurrently, so they are only weighted: the low lane handles fewer
+  // requests at once so it does not starve the others
+  request_lanes = {
+    high = {
+      max_instance_request_concurrency = 80
+    }
+    low = {
+      max_instance_request_concurrency = 10
+    }
+  }
+
   environment_variables = merge(
     {
       "PROJECT_ID" = var.project_id
 
-      "API_REQUEST_TOPIC_ID"  = google_pubsub_topic.iracing_api_topic.id
-      "API_RESPONSE_TOPIC_ID" = google_pubsub_topic.iracing_response_topic.id
+      "API_REQUEST_TOPIC_ID"      = google_pubsub_topic.iracing_api_topic.id
+      "API_REQUEST_HIGH_TOPIC_ID" = google_pubsub_topic.iracing_api_lane_topic["high"].id
+      "API_REQUEST_LOW_TOPIC_ID"  = google_pubsub_topic.iracing_api_lane_topic["low"].id
+      "API_RESPONSE_TOPIC_ID"     = google_pubsub_topic.iracing_response_topic.id
 
       "IRACING_CLIENT_ID"     = var.iracing_client_id
       "IRACING_CLIENT_SECRET" = var.iracing_client_secret
       "IRACING_USERNAME"      = var.iracing_username
       "IRACING_PASSWORD"      = var.iracing_password
+      "IRACING_ACCOUNTS"      = var.iracing_accounts
 
       "MONGODB_URI"      = var.database_url
       "MONGODB_DATABASE" = var.database_name
+
+      "BLOB_STORE_URI"    = "gs://${google_storage_bucket.responses.name}"
+      "ARCHIVE_URI"       = "gs://${google_storage_bucket.archive.name}"
+      "RESPONSE_ENCODING" = var.response_encoding
+
+      "RESPONSE_CACHE_URI"  = "mongodb"
+      "RESPONSE_CACHE_TTLS" = var.response_cache_ttls
+
+      "DRIVER_REFRESH_WINDOW" = var.driver_refresh_window
     },
   )
 }
@@ -51,6 +75,10 @@ resource "google_project_service" "cloudrun" {
   service            = "run.googleapis.com"
   disable_on_destroy = false
 }
+resource "google_project_service" "cloudscheduler" {
+  service            = "cloudscheduler.googleapis.com"
+  disable_on_destroy = false
+}
 
 
 // PUB/SUB
@@ -59,10 +87,99 @@ resource "google_pubsub_topic" "iracing_api_topic" {
   name = "iracing_api_topic"
 }
 
+resource "google_pubsub_topic" "iracing_api_lane_topic" {
+  for_each = local.request_lanes
+
+  name = "iracing_api_topic-${each.key}"
+}
+
 resource "google_pubsub_topic" "iracing_response_topic" {
   name = "iracing_response_topic"
 }
 
+resource "google_pubsub_topic" "iracing_release_topic" {
+  name = "iracing_release_topic"
+}
+
+
+// SCHEDULED REQUESTS
+
+// The assets are requested by the processor once the tracks are stored. The
+// refresh skips the response cache and the request ledger, as the tracks can
+// be cached for longer than the schedule.
+resource "google_cloud_scheduler_job" "track_refresh" {
+  name      = "iracing-refresh-track-get"
+  schedule  = var.track_refresh_schedule
+  time_zone = "Etc/UTC"
+  region    = var.region
+
+  depends_on = [google_project_service.cloudscheduler]
+
+  pubsub_target {
+    topic_name = google_pubsub_topic.iracing_api_topic.id
+    data       = base64encode(jsonencode({ endpoint = "/data/track/get", force_refresh = true }))
+    attributes = {
+      endpoint = "/data/track/get"
+    }
+  }
+}
+
+
+// Pub/Sub cannot delay a redelivery, so the deferred requests are parked in the
+// request ledger and published again once due
+resource "google_cloud_scheduler_job" "release_deferred" {
+  name      = "iracing-release-deferred"
+  schedule  = "* * * * *"
+  time_zone = "Etc/UTC"
+  region    = var.region
+
+  depends_on = [google_project_service.cloudscheduler]
+
+  pubsub_target {
+    topic_name = google_pubsub_topic.iracing_release_topic.id
+    data       = base64encode("release")
+  }
+}
+
+
+// RESPONSE PAYLOADS
+
+resource "google_storage_bucket" "responses" {
+  name                        = "iracing-responses-${random_id.bucket_prefix.hex}"
+  location                    = var.region
+  uniform_bucket_level_access = true
+  force_destroy               = true
+
+  lifecycle_rule {
+    condition {
+      age = var.response_payload_retention_days
+    }
+    action {
+      type = "Delete"
+    }
+  }
+}
+
+// The index is listed and read by every replay, only the payloads are moved to
+// a colder storage class
+resource "google_storage_bucket" "archive" {
+  name                        = "iracing-archive-${random_id.bucket_prefix.hex}"
+  location                    = var.region
+  uniform_bucket_level_access = true
+  storage_class               = "STANDARD"
+
+  lifecycle_rule {
+    condition {
+      age            = 30
+      matches_prefix = ["objects/"]
+    }
+    action {
+      type          = "SetStorageClass"
+      storage_class = "NEARLINE"
+    }
+  }
+}
+
 
 // SOURCE CODE
 
@@ -79,7 +196,8 @@ data "archive_file" "source_code" {
     "**/.terraform/**",
     "**/infrastructure/**",
     "**/*.zip",
-    "**/.git/**"
+    "**/.git/**",
+    "iracing_*"
   ]
 }
 
@@ -135,6 +253,18 @@ resource "google_project_iam_member" "runner_pubsub_publisher" {
   member  = "serviceAccount:${google_service_account.runner.email}"
 }
 
+resource "google_storage_bucket_iam_member" "runner_responses_admin" {
+  bucket = google_storage_bucket.responses.name
+  role   = "roles/storage.objectAdmin"
+  member = "serviceAccount:${google_service_account.runner.email}"
+}
+
+resource "google_storage_bucket_iam_member" "runner_archive_admin" {
+  bucket = google_storage_bucket.archive.name
+  role   = "roles/storage.objectAdmin"
+  member = "serviceAccount:${google_service_account.runner.email}"
+}
+
 resource "google_project_iam_member" "runner_log_writer" {
   project = google_service_account.runner.project
   role    = "roles/logging.logWriter"
@@ -208,6 +338,76 @@ resource "google_cloud_run_service_iam_member" "invoker_api" {
 }
 
 
+resource "google_cloudfunctions2_function" "api_lane" {
+  for_each = local.request_lanes
+
+  name     = "iracing-scraper-api-${each.key}"
+  location = var.region
+
+  depends_on = [
+    google_project_service.cloudbuild,
+    google_project_service.cloudfunctions,
+    google_project_service.eventarc,
+    google_project_service.cloudrun,
+    google_storage_bucket_object.default,
+  ]
+
+  build_config {
+    runtime         = "go125"
+    entry_point     = "ApiPull"
+    service_account = google_service_account.cloudbuild.id
+
+    source {
+      storage_source {
+        bucket = google_storage_bucket.source.name
+        object = google_storage_bucket_object.default.name
+      }
+    }
+  }
+
+  service_config {
+    max_instance_count               = 1
+    min_instance_count               = 0
+    max_instance_request_concurrency = each.value.max_instance_request_concurrency
+    available_memory                 = "256M"
+    available_cpu                    = "1"
+    timeout_seconds                  = 540
+    environment_variables            = local.environment_variables
+    ingress_settings                 = "ALLOW_INTERNAL_ONLY"
+    all_traffic_on_latest_revision   = true
+    service_account_email            = google_service_account.runner.email
+  }
+
+  event_trigger {
+    trigger_region        = var.region
+    event_type            = "google.cloud.pubsub.topic.v1.messagePublished"
+    pubsub_topic          = google_pubsub_topic.iracing_api_lane_topic[each.key].id
+    retry_policy          = "RETRY_POLICY_RETRY"
+    service_account_email = google_service_account.invoker.email
+  }
+}
+
+resource "google_cloudfunctions2_function_iam_member" "invoker_api_lane" {
+  for_each = local.request_lanes
+
+  project        = google_cloudfunctions2_function.api_lane[each.key].project
+  location       = google_cloudfunctions2_function.api_lane[each.key].location
+  cloud_function = google_cloudfunctions2_function.api_lane[each.key].name
+  role           = "roles/cloudfunctions.invoker"
+  member         = "serviceAccount:${google_service_account.invoker.email}"
+}
+
+resource "google_cloud_run_service_iam_member" "invoker_api_lane" {
+  for_each = local.request_lanes
+
+  project  = google_cloudfunctions2_function.api_lane[each.key].project
+  location = google_cloudfunctions2_function.api_lane[each.key].location
+  service  = google_cloudfunctions2_function.api_lane[each.key].name
+  role     = "roles/run.invoker"
+  member   = "serviceAccount:${google_service_account.invoker.email}"
+}
+
+
 // API RESPONSES
 
 resource "google_cloudfunctions2_function" "responses" {
@@ -272,3 +472,69 @@ resource "google_cloud_run_service_iam_member" "invoker_responses" {
   role     = "roles/run.invoker"
   member   = "serviceAccount:${google_service_account.invoker.email}"
 }
+
+
+// DEFERRED REQUESTS
+
+resource "google_cloudfunctions2_function" "release" {
+  name     = "iracing-scraper-release"
+  location = var.region
+
+  depends_on = [
+    google_project_service.cloudbuild,
+    google_project_service.cloudfunctions,
+    google_project_service.eventarc,
+    google_project_service.cloudrun,
+    google_storage_bucket_object.default,
+  ]
+
+  build_config {
+    runtime         = "go125"
+    entry_point     = "ReleaseDeferred"
+    service_account = google_service_account.cloudbuild.id
+
+    source {
+      storage_source {
+        bucket = google_storage_bucket.source.name
+        object = google_storage_bucket_object.default.name
+      }
+    }
+  }
+
+  service_config {
+    max_instance_count               = 1
+    min_instance_count               = 0
+    max_instance_request_concurrency = 1
+    available_memory                 = "256M"
+    available_cpu                    = "1"
+    timeout_seconds                  = 60
+    environment_variables            = local.environment_variables
+    ingress_settings                 = "ALLOW_INTERNAL_ONLY"
+    all_traffic_on_latest_revision   = true
+    service_account_email            = google_service_account.runner.email
+  }
+
+  event_trigger {
+    trigger_region        = var.region
+    event_type            = "google.cloud.pubsub.topic.v1.messagePublished"
+    pubsub_topic          = google_pubsub_topic.iracing_release_topic.id
+    retry_policy          = "RETRY_POLICY_DO_NOT_RETRY"
+    service_account_email = google_service_account.invoker.email
+  }
+}
+
+resource "google_cloudfunctions2_function_iam_member" "invoker_release" {
+  project        = google_cloudfunctions2_function.release.project
+  location       = google_cloudfunctions2_function.release.location
+  cloud_function = google_cloudfunctions2_function.release.name
+  role           = "roles/cloudfunctions.invoker"
+  member         = "serviceAccount:${google_service_account.invoker.email}"
+}
+
+resource "google_cloud_run_service_iam_member" "invoker_release" {
+  project  = google_cloudfunctions2_function.release.project
+  location = google_cloudfunctions2_function.release.location
+  service  = google_cloudfunctions2_function.release.name
+  role     = "roles/run.invoker"
+  member   = "serviceAccount:${google_service_account.invoker.email}"
+}
@@ -12,6 +12,42 @@ variable "project_id" {
 }
 
 
+variable "response_encoding" {
+  description = "The compression applied to API response messages: gzip, zstd or empty for none."
+  type        = string
+  default     = "zstd"
+
+  validation {
+    condition     = contains(["", "gzip", "zstd"], var.response_encoding)
+    error_message = "The response encoding must be gzip, zstd or empty."
+  }
+}
+
+variable "response_cache_ttls" {
+  description = "Comma-separated endpoint=duration pairs of the API responses to cache, each longer than the freshness of the endpoint."
+  type        = string
+  default     = "/data/car/get=168h,/data/carclass/get=168h,/data/track/get=168h"
+}
+
+variable "response_payload_retention_days" {
+  description = "How many days the payloads of the oversized API responses are kept. A dead-lettered response referencing a payload can only be replayed within that time."
+  type        = number
+  default     = 30
+}
+
+variable "driver_refresh_window" {
+  description = "How long a driver is not requested again after its sessions, e.g. 168h. Empty to not request the drivers."
+  type        = string
+  default     = ""
+}
+
+variable "track_refresh_schedule" {
+  description = "The cron schedule, in UTC, of the requests refreshing the tracks, which then request their assets."
+  type        = string
+  default     = "0 4 * * 1"
+}
+
+
 // DATABASE
 
 variable "database_url" {
@@ -46,3 +82,9 @@ variable "iracing_password" {
   description = "The password used to authenticate with the iRacing API."
   type        = string
 }
+
+variable "iracing_accounts" {
+  description = "JSON array of the iRacing accounts to rotate the API calls across, with username and password. Replaces the single username and password when set."
+  type        = string
+  default     = ""
+}
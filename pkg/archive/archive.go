@@ -0,0 +1,153 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/blob"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ledger"
+)
+
+// Layout of the fetch times in the index keys, sortable as strings
+const fetchTimeLayout = "20060102T150405.000000000Z"
+
+// Record is an index entry of the archive, describing a single API call.
+type Record struct {
+	Endpoint  string            `json:"endpoint"`
+	Params    map[string]string `json:"params"`
+	FetchedAt time.Time         `json:"fetched_at"`
+	MessageID string            `json:"message_id,omitempty"`
+	RootID    string            `json:"root_id,omitempty"`
+
+	// Digests of the raw response body and of every chunk file
+	Body   string   `json:"body"`
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// Archive keeps every raw iRacing payload, addressed by its SHA-256 digest
+// so identical payloads are stored once, and an index of the API calls by
+// endpoint, params and fetch time.
+type Archive struct {
+	store blob.Store
+}
+
+func New(store blob.Store) *Archive {
+	return &Archive{store: store}
+}
+
+// Open returns the archive backed by the blob store at uri, or nil when uri
+// is empty, which disables archiving.
+func Open(ctx context.Context, uri string) (*Archive, error) {
+	if uri == "" {
+		return nil, nil
+	}
+
+	store, err := blob.Open(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(store), nil
+}
+
+func objectKey(digest string) string {
+	return fmt.Sprintf("objects/%s/%s", digest[:2], digest)
+}
+
+// requestPrefix returns the index prefix of the calls of a request.
+func requestPrefix(endpoint string, params map[string]string) string {
+	sum := sha256.Sum256([]byte(ledger.Key(endpoint, params)))
+	return endpointPrefix(endpoint) + hex.EncodeToString(sum[:8]) + "/"
+}
+
+// endpointPrefix returns the index prefix of the calls of an endpoint.
+func endpointPrefix(endpoint string) string {
+	return "index/" + strings.Trim(endpoint, "/") + "/"
+}
+
+// Put stores a raw payload and returns its digest.
+func (a *Archive) Put(ctx context.Context, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	err := a.store.Put(ctx, objectKey(digest), data)
+	if err != nil {
+		return "", fmt.Errorf("failed to archive payload: %w", err)
+	}
+
+	return digest, nil
+}
+
+// Get returns the raw payload with the given digest.
+func (a *Archive) Get(ctx context.Context, digest string) ([]byte, error) {
+	if len(digest) < 2 {
+		return nil, fmt.Errorf("invalid digest: %q", digest)
+	}
+
+	return a.store.Get(ctx, objectKey(digest))
+}
+
+// Record adds an API call to the index. A nil Archive ignores it.
+func (a *Archive) Record(ctx context.Context, record *Record) error {
+	if a == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal archive record: %w", err)
+	}
+
+	key := requestPrefix(record.Endpoint, record.Params) + record.FetchedAt.UTC().Format(fetchTimeLayout) + ".json"
+	err = a.store.Put(ctx, key, data)
+	if err != nil {
+		return fmt.Errorf("failed to write archive record: %w", err)
+	}
+
+	return nil
+}
+
+// Find returns the recorded calls of a request, oldest first.
+func (a *Archive) Find(ctx context.Context, endpoint string, params map[string]string) ([]Record, error) {
+	return a.list(ctx, requestPrefix(endpoint, params))
+}
+
+// List returns the recorded calls of an endpoint, or of every endpoint when
+// endpoint is empty.
+func (a *Archive) List(ctx context.Context, endpoint string) ([]Record, error) {
+	if endpoint == "" {
+		return a.list(ctx, "index/")
+	}
+
+	return a.list(ctx, endpointPrefix(endpoint))
+}
+
+func (a *Archive) list(ctx context.Context, prefix string) ([]Record, error) {
+	keys, err := a.store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		data, err := a.store.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive record %s: %w", key, err)
+		}
+
+		var record Record
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal archive record %s: %w", key, err)
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
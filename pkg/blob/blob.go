@@ -0,0 +1,44 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps opaque payloads addressed by a slash-separated key.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Delete removes the blob, if it exists.
+	Delete(ctx context.Context, key string) error
+
+	// List returns the sorted keys starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Open returns the store described by uri: "file:///some/dir" for a local
+// directory or "gs://bucket/prefix" for Google Cloud Storage.
+func Open(ctx context.Context, uri string) (Store, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob store uri: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file", "":
+		return NewLocalStore(filepath.FromSlash(u.Path)), nil
+
+	case "gs":
+		return NewGCSStore(ctx, u.Host, strings.TrimPrefix(u.Path, "/"))
+
+	default:
+		return nil, fmt.Errorf("unsupported blob store scheme: %s", u.Scheme)
+	}
+}
@@ -0,0 +1,90 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// GCSStore keeps blobs as objects in a Google Cloud Storage bucket.
+type GCSStore struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func NewGCSStore(ctx context.Context, bucket string, prefix string) (*GCSStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %w", err)
+	}
+
+	return &GCSStore{
+		bucket: client.Bucket(bucket),
+		prefix: prefix,
+	}, nil
+}
+
+func (s *GCSStore) Put(ctx context.Context, key string, data []byte) error {
+	w := s.bucket.Object(path.Join(s.prefix, key)).NewWriter(ctx)
+
+	_, err := w.Write(data)
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	return w.Close()
+}
+
+func (s *GCSStore) Get(ctx context.Context, key string) ([]byte, error) {
+	r, err := s.bucket.Object(path.Join(s.prefix, key)).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func (s *GCSStore) Delete(ctx context.Context, key string) error {
+	err := s.bucket.Object(path.Join(s.prefix, key)).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *GCSStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+
+	// Not joined with path.Join, which would drop a trailing slash
+	root := ""
+	if s.prefix != "" {
+		root = strings.TrimSuffix(s.prefix, "/") + "/"
+	}
+
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: root + prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list blobs: %w", err)
+		}
+
+		keys = append(keys, strings.TrimPrefix(attrs.Name, root))
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,59 @@
+package bus
+
+import (
+	"context"
+	"time"
+)
+
+// Message is a transport-agnostic bus message.
+type Message struct {
+	ID              string
+	Data            []byte
+	Attributes      map[string]string
+	DeliveryAttempt *int
+
+	ack       func()
+	nack      func()
+	nackAfter func(time.Duration)
+}
+
+// Ack acknowledges the message, removing it from the queue.
+func (m *Message) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+// Nack signals that the message could not be processed and must be redelivered.
+func (m *Message) Nack() {
+	if m.nack != nil {
+		m.nack()
+	}
+}
+
+// NackAfter redelivers the message once d has elapsed, without holding up the
+// receiver in the meantime, and returns true. It returns false, leaving the
+// message unsettled, when the transport cannot delay a redelivery.
+func (m *Message) NackAfter(d time.Duration) bool {
+	if m.nackAfter == nil {
+		return false
+	}
+
+	m.nackAfter(d)
+	return true
+}
+
+// PublishResult is the outcome of an asynchronous publish.
+type PublishResult interface {
+	// Get blocks until the message is published and returns its server-assigned ID.
+	Get(ctx context.Context) (string, error)
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, msg *Message) PublishResult
+}
+
+type Subscriber interface {
+	// Receive calls f for every message until ctx is done.
+	Receive(ctx context.Context, f func(context.Context, *Message)) error
+}
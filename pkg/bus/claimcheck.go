@@ -0,0 +1,135 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/blob"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+// DefaultClaimCheckThreshold keeps messages safely below the 10 MB Pub/Sub limit.
+const DefaultClaimCheckThreshold = 8 * 1024 * 1024
+
+// ClaimCheck moves oversized response payloads to a blob store, leaving only
+// a reference in the bus message.
+type ClaimCheck struct {
+	Store     blob.Store
+	Threshold int
+}
+
+func NewClaimCheck(store blob.Store, threshold int) *ClaimCheck {
+	if threshold <= 0 {
+		threshold = DefaultClaimCheckThreshold
+	}
+
+	return &ClaimCheck{
+		Store:     store,
+		Threshold: threshold,
+	}
+}
+
+// Offload writes the body and chunks of the response to the store when the
+// encoded message exceeds the threshold. A nil ClaimCheck never offloads.
+func (c *ClaimCheck) Offload(ctx context.Context, res *ApiResponse) error {
+	if c == nil {
+		return nil
+	}
+
+	// The payloads are escaped in the message, which can take much more than their length
+	data, err := json.Marshal(res)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to marshal API response: %w", err))
+	}
+
+	if len(data) <= c.Threshold {
+		return nil
+	}
+
+	id := res.MessageID
+	if id == "" {
+		id = uuid.NewString()
+	}
+
+	bodyRef := fmt.Sprintf("responses/%s/body.json", id)
+	err = c.Store.Put(ctx, bodyRef, []byte(res.Body))
+	if err != nil {
+		return fmt.Errorf("failed to store response body: %w", err)
+	}
+
+	res.Body = ""
+	res.BodyRef = bodyRef
+
+	if res.Chunks != nil {
+		chunksRef := fmt.Sprintf("responses/%s/chunks.json", id)
+		err = c.Store.Put(ctx, chunksRef, []byte(*res.Chunks))
+		if err != nil {
+			return fmt.Errorf("failed to store response chunks: %w", err)
+		}
+
+		res.Chunks = nil
+		res.ChunksRef = chunksRef
+	}
+
+	return nil
+}
+
+// Resolve loads the payloads referenced by the response back into it.
+func (c *ClaimCheck) Resolve(ctx context.Context, res *ApiResponse) error {
+	if res.BodyRef == "" && res.ChunksRef == "" {
+		return nil
+	}
+
+	if c == nil {
+		return fmt.Errorf("response references stored payloads but no blob store is configured")
+	}
+
+	if res.BodyRef != "" {
+		body, err := c.Store.Get(ctx, res.BodyRef)
+		if err != nil {
+			return classifyBlobError(fmt.Errorf("failed to load response body %s: %w", res.BodyRef, err))
+		}
+
+		res.Body = string(body)
+		res.BodyRef = ""
+	}
+
+	if res.ChunksRef != "" {
+		chunks, err := c.Store.Get(ctx, res.ChunksRef)
+		if err != nil {
+			return classifyBlobError(fmt.Errorf("failed to load response chunks %s: %w", res.ChunksRef, err))
+		}
+
+		chunksStr := string(chunks)
+		res.Chunks = &chunksStr
+		res.ChunksRef = ""
+	}
+
+	return nil
+}
+
+// OpenClaimCheck opens the blob store at uri, returning nil when uri is empty.
+func OpenClaimCheck(ctx context.Context, uri string, threshold int) (*ClaimCheck, error) {
+	if uri == "" {
+		return nil, nil
+	}
+
+	store, err := blob.Open(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClaimCheck(store, threshold), nil
+}
+
+// classifyBlobError marks payloads that are gone as permanent failures.
+func classifyBlobError(err error) error {
+	if errors.Is(err, blob.ErrNotFound) {
+		return failure.Permanent(err)
+	}
+
+	return err
+}
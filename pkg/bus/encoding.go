@@ -0,0 +1,136 @@
+package bus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// EncodingAttribute is the message attribute describing how Data is compressed.
+// Messages without it are plain JSON.
+const EncodingAttribute = "encoding"
+
+const (
+	EncodingIdentity = ""
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// CheckEncoding returns an error when the encoding is not supported, so a
+// misconfigured publisher fails at startup instead of on every message.
+func CheckEncoding(encoding string) error {
+	switch encoding {
+	case EncodingIdentity, EncodingGzip, EncodingZstd:
+		return nil
+	default:
+		return fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+// Encode compresses data with the given encoding.
+func Encode(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingIdentity:
+		return data, nil
+
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case EncodingZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+// Decode decompresses data encoded with the given encoding.
+func Decode(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingIdentity:
+		return data, nil
+
+	case EncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+
+	case EncodingZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+// DecodeMessageData returns the uncompressed data of a message given its attributes.
+func DecodeMessageData(data []byte, attributes map[string]string) ([]byte, error) {
+	return Decode(attributes[EncodingAttribute], data)
+}
+
+type encodingPublisher struct {
+	pub      Publisher
+	encoding string
+}
+
+// NewEncodingPublisher compresses the data of every published message and
+// records the encoding in its attributes.
+func NewEncodingPublisher(pub Publisher, encoding string) Publisher {
+	if encoding == EncodingIdentity {
+		return pub
+	}
+
+	return &encodingPublisher{
+		pub:      pub,
+		encoding: encoding,
+	}
+}
+
+func (p *encodingPublisher) Publish(ctx context.Context, msg *Message) PublishResult {
+	data, err := Encode(p.encoding, msg.Data)
+	if err != nil {
+		return &failedPublishResult{err: fmt.Errorf("failed to encode message: %w", err)}
+	}
+
+	attributes := maps.Clone(msg.Attributes)
+	if attributes == nil {
+		attributes = make(map[string]string)
+	}
+	attributes[EncodingAttribute] = p.encoding
+
+	return p.pub.Publish(ctx, &Message{
+		Data:       data,
+		Attributes: attributes,
+	})
+}
+
+type failedPublishResult struct {
+	err error
+}
+
+func (r *failedPublishResult) Get(ctx context.Context) (string, error) {
+	return "", r.err
+}
@@ -0,0 +1,63 @@
+package bus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Envelope carries the correlation and lineage metadata of a bus message.
+// RootID identifies the whole crawl, ParentID the message that spawned this one.
+type Envelope struct {
+	MessageID string     `json:"message_id,omitempty"`
+	RootID    string     `json:"root_id,omitempty"`
+	ParentID  string     `json:"parent_id,omitempty"`
+	Hops      int        `json:"hops,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+
+	// Priority lane of the request, inherited by the requests it spawns
+	Priority string `json:"priority,omitempty"`
+}
+
+// NewEnvelope starts a new crawl.
+func NewEnvelope() Envelope {
+	id := uuid.NewString()
+	now := time.Now().UTC()
+
+	return Envelope{
+		MessageID: id,
+		RootID:    id,
+		CreatedAt: &now,
+	}
+}
+
+// Child returns the envelope of a message spawned by the current one.
+func (e Envelope) Child() Envelope {
+	child := NewEnvelope()
+	child.ParentID = e.MessageID
+	child.Hops = e.Hops + 1
+	child.Priority = e.Priority
+
+	if e.RootID != "" {
+		child.RootID = e.RootID
+	}
+
+	return child
+}
+
+// Ensure returns the envelope itself, or a new root envelope for messages
+// published without one.
+func (e Envelope) Ensure() Envelope {
+	if e.MessageID == "" {
+		root := NewEnvelope()
+		root.Priority = e.Priority
+		return root
+	}
+
+	return e
+}
+
+func (e Envelope) String() string {
+	return fmt.Sprintf("root=%s parent=%s msg=%s hop=%d", e.RootID, e.ParentID, e.MessageID, e.Hops)
+}
@@ -0,0 +1,203 @@
+package bus
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryBus is an in-process bus where every topic has exactly one implicit
+// subscription. It keeps track of the messages that were published but not
+// yet acknowledged, so callers can wait for the whole bus to drain.
+type MemoryBus struct {
+	mu      sync.Mutex
+	topics  map[string]*memoryTopic
+	pending int
+	idle    chan struct{}
+	nextID  int64
+}
+
+type memoryTopic struct {
+	bus    *MemoryBus
+	queue  []*Message
+	notify chan struct{}
+}
+
+func NewMemoryBus() *MemoryBus {
+	idle := make(chan struct{})
+	close(idle)
+
+	return &MemoryBus{
+		topics: make(map[string]*memoryTopic),
+		idle:   idle,
+	}
+}
+
+func (b *MemoryBus) topic(topicID string) *memoryTopic {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, ok := b.topics[topicID]
+	if !ok {
+		t = &memoryTopic{
+			bus:    b,
+			notify: make(chan struct{}, 1),
+		}
+		b.topics[topicID] = t
+	}
+
+	return t
+}
+
+// Publisher returns a publisher for the given topic, creating it if needed.
+func (b *MemoryBus) Publisher(topicID string) Publisher {
+	return b.topic(topicID)
+}
+
+// Subscriber returns a subscriber for the given topic, creating it if needed.
+// Several subscribers on the same topic compete for its messages.
+func (b *MemoryBus) Subscriber(topicID string) Subscriber {
+	return b.topic(topicID)
+}
+
+// Pending returns the number of messages published but not yet acknowledged.
+func (b *MemoryBus) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.pending
+}
+
+// WaitIdle blocks until every published message has been acknowledged or ctx is done.
+func (b *MemoryBus) WaitIdle(ctx context.Context) error {
+	b.mu.Lock()
+	idle := b.idle
+	b.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *MemoryBus) settle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending--
+	if b.pending == 0 {
+		close(b.idle)
+	}
+}
+
+func (t *memoryTopic) push(msg *Message) {
+	t.bus.mu.Lock()
+	t.queue = append(t.queue, msg)
+	t.bus.mu.Unlock()
+
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (t *memoryTopic) pop() *Message {
+	t.bus.mu.Lock()
+	defer t.bus.mu.Unlock()
+
+	if len(t.queue) == 0 {
+		return nil
+	}
+
+	msg := t.queue[0]
+	t.queue = t.queue[1:]
+
+	// Wake up other receivers if there is still work to do
+	if len(t.queue) > 0 {
+		select {
+		case t.notify <- struct{}{}:
+		default:
+		}
+	}
+
+	return msg
+}
+
+// Backlog returns the number of messages waiting to be received.
+func (t *memoryTopic) Backlog() int {
+	t.bus.mu.Lock()
+	defer t.bus.mu.Unlock()
+
+	return len(t.queue)
+}
+
+func (t *memoryTopic) Publish(ctx context.Context, msg *Message) PublishResult {
+	t.bus.mu.Lock()
+	t.bus.nextID++
+	id := strconv.FormatInt(t.bus.nextID, 10)
+	if t.bus.pending == 0 {
+		t.bus.idle = make(chan struct{})
+	}
+	t.bus.pending++
+	t.bus.mu.Unlock()
+
+	attempt := 0
+	t.push(&Message{
+		ID:              id,
+		Data:            msg.Data,
+		Attributes:      msg.Attributes,
+		DeliveryAttempt: &attempt,
+	})
+
+	return &memoryPublishResult{id: id}
+}
+
+// Receive delivers messages one at a time. A message that is neither acked
+// nor nacked by the time f returns is nacked.
+func (t *memoryTopic) Receive(ctx context.Context, f func(context.Context, *Message)) error {
+	for {
+		queued := t.pop()
+		if queued == nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-t.notify:
+			}
+			continue
+		}
+
+		attempt := *queued.DeliveryAttempt + 1
+		var settle sync.Once
+
+		msg := &Message{
+			ID:              queued.ID,
+			Data:            queued.Data,
+			Attributes:      queued.Attributes,
+			DeliveryAttempt: &attempt,
+		}
+		msg.ack = func() {
+			settle.Do(t.bus.settle)
+		}
+		msg.nack = func() {
+			settle.Do(func() { t.push(msg) })
+		}
+		msg.nackAfter = func(d time.Duration) {
+			// The message stays pending, so the bus is not idle until it is handled
+			settle.Do(func() { time.AfterFunc(d, func() { t.push(msg) }) })
+		}
+
+		f(ctx, msg)
+		msg.Nack()
+	}
+}
+
+type memoryPublishResult struct {
+	id string
+}
+
+func (r *memoryPublishResult) Get(ctx context.Context) (string, error) {
+	return r.id, nil
+}
@@ -0,0 +1,186 @@
+package bus
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PriorityAttribute is the message attribute used to route a request to its lane.
+const PriorityAttribute = "priority"
+
+const (
+	// A lane that cannot report its backlog is assumed to have one for this long after its last message
+	laneBacklogGrace = 2 * time.Second
+
+	// How often a lane waiting for the backlog of a higher lane checks it again
+	laneBacklogPoll = 250 * time.Millisecond
+)
+
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// Priorities lists the priority lanes from the first to the last to be drained.
+var Priorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// NormalizePriority maps empty and unknown priorities to the normal lane.
+func NormalizePriority(priority string) string {
+	switch priority {
+	case PriorityHigh, PriorityLow:
+		return priority
+	default:
+		return PriorityNormal
+	}
+}
+
+// PriorityLaneID returns the topic or subscription ID of a priority lane.
+// The normal lane keeps the base ID, so existing deployments keep working.
+func PriorityLaneID(baseID string, priority string) string {
+	priority = NormalizePriority(priority)
+	if priority == PriorityNormal {
+		return baseID
+	}
+
+	return baseID + "-" + priority
+}
+
+type priorityPublisher struct {
+	lanes map[string]Publisher
+}
+
+// NewPriorityPublisher routes every message to the publisher of the lane
+// named by its priority attribute.
+func NewPriorityPublisher(lanes map[string]Publisher) Publisher {
+	return &priorityPublisher{lanes: lanes}
+}
+
+func (p *priorityPublisher) Publish(ctx context.Context, msg *Message) PublishResult {
+	lane, ok := p.lanes[NormalizePriority(msg.Attributes[PriorityAttribute])]
+	if !ok {
+		lane = p.lanes[PriorityNormal]
+	}
+
+	return lane.Publish(ctx, msg)
+}
+
+// Backlog is implemented by the subscribers that can tell how many messages
+// are waiting to be received.
+type Backlog interface {
+	Backlog() int
+}
+
+type prioritySubscriber struct {
+	lanes []Subscriber
+
+	mu       sync.Mutex
+	active   []int
+	received []time.Time
+	changed  chan struct{}
+}
+
+// NewPrioritySubscriber receives from several lanes, ordered from the highest
+// priority. A message of a lane is only handled while no higher lane is
+// handling a message or has a backlog.
+func NewPrioritySubscriber(lanes ...Subscriber) Subscriber {
+	return &prioritySubscriber{
+		lanes:    lanes,
+		active:   make([]int, len(lanes)),
+		received: make([]time.Time, len(lanes)),
+		changed:  make(chan struct{}),
+	}
+}
+
+func (s *prioritySubscriber) Receive(ctx context.Context, f func(context.Context, *Message)) error {
+	errs := make(chan error, len(s.lanes))
+
+	for i, lane := range s.lanes {
+		go func() {
+			errs <- lane.Receive(ctx, func(ctx context.Context, msg *Message) {
+				s.receive(i)
+
+				if !s.enter(ctx, i) {
+					msg.Nack()
+					return
+				}
+				defer s.leave(i)
+
+				f(ctx, msg)
+			})
+		}()
+	}
+
+	// Return the first error once every lane stopped
+	var firstErr error
+	for range s.lanes {
+		err := <-errs
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// receive records that a lane just received a message.
+func (s *prioritySubscriber) receive(lane int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.received[lane] = time.Now()
+}
+
+// backlogged returns true when a lane has messages waiting to be received.
+// A lane that cannot tell is assumed to have some shortly after its last message.
+func (s *prioritySubscriber) backlogged(lane int) bool {
+	if backlog, ok := s.lanes[lane].(Backlog); ok {
+		return backlog.Backlog() > 0
+	}
+
+	return time.Since(s.received[lane]) < laneBacklogGrace
+}
+
+// enter waits until no higher lane is busy or backlogged and marks the lane as busy.
+func (s *prioritySubscriber) enter(ctx context.Context, lane int) bool {
+	for {
+		s.mu.Lock()
+
+		busy := false
+		for higher, active := range s.active[:lane] {
+			if active > 0 || s.backlogged(higher) {
+				busy = true
+				break
+			}
+		}
+
+		if !busy {
+			s.active[lane]++
+			s.mu.Unlock()
+			return true
+		}
+
+		changed := s.changed
+		s.mu.Unlock()
+
+		// The backlogs are polled, as they change without any lane leaving
+		select {
+		case <-changed:
+		case <-time.After(laneBacklogPoll):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (s *prioritySubscriber) leave(lane int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active[lane]--
+
+	// Wake up the lanes waiting for this one
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
@@ -0,0 +1,46 @@
+package bus
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub/v2"
+)
+
+type pubSubPublisher struct {
+	pub *pubsub.Publisher
+}
+
+// NewPubSubPublisher adapts a Google Pub/Sub publisher to the bus Publisher interface.
+func NewPubSubPublisher(pub *pubsub.Publisher) Publisher {
+	return &pubSubPublisher{pub: pub}
+}
+
+func (p *pubSubPublisher) Publish(ctx context.Context, msg *Message) PublishResult {
+	return p.pub.Publish(ctx, &pubsub.Message{
+		Data:       msg.Data,
+		Attributes: msg.Attributes,
+	})
+}
+
+type pubSubSubscriber struct {
+	sub *pubsub.Subscriber
+}
+
+// NewPubSubSubscriber adapts a Google Pub/Sub subscriber to the bus Subscriber interface.
+func NewPubSubSubscriber(sub *pubsub.Subscriber) Subscriber {
+	return &pubSubSubscriber{sub: sub}
+}
+
+func (s *pubSubSubscriber) Receive(ctx context.Context, f func(context.Context, *Message)) error {
+	return s.sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		f(ctx, &Message{
+			ID:              msg.ID,
+			Data:            msg.Data,
+			Attributes:      msg.Attributes,
+			DeliveryAttempt: msg.DeliveryAttempt,
+
+			ack:  msg.Ack,
+			nack: msg.Nack,
+		})
+	})
+}
@@ -1,14 +1,39 @@
 package bus
 
+import "time"
+
 type ApiRequest struct {
+	Envelope
+
 	Endpoint string            `json:"endpoint"`
 	Params   map[string]string `json:"params"`
 	Chunks   bool              `json:"chunks,omitempty"`
+
+	// The request is deferred until this time, and responses fetched before it are not reused
+	NotBefore *time.Time `json:"not_before,omitempty"`
+
+	// Call iRacing even when a fresh or cached response exists
+	ForceRefresh bool `json:"force_refresh,omitempty"`
+}
+
+// Due returns true when the request can be executed now.
+func (r *ApiRequest) Due() bool {
+	return r.NotBefore == nil || !time.Now().Before(*r.NotBefore)
 }
 
 type ApiResponse struct {
+	Envelope
+
 	Endpoint string            `json:"endpoint"`
 	Params   map[string]string `json:"params"`
 	Body     string            `json:"body"`
 	Chunks   *string           `json:"chunks,omitempty"`
+
+	// Set instead of Body and Chunks when the payload was moved to a blob store
+	BodyRef   string `json:"body_ref,omitempty"`
+	ChunksRef string `json:"chunks_ref,omitempty"`
+
+	// Copied from the request, so the follow-up requests of a refetch are refetched too
+	NotBefore    *time.Time `json:"not_before,omitempty"`
+	ForceRefresh bool       `json:"force_refresh,omitempty"`
 }
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/blob"
+)
+
+// BlobStore keeps the cached entries as JSON files in a blob store.
+type BlobStore struct {
+	store blob.Store
+}
+
+func NewBlobStore(store blob.Store) *BlobStore {
+	return &BlobStore{store: store}
+}
+
+func blobKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("cache/%s.json", hex.EncodeToString(sum[:]))
+}
+
+func (s *BlobStore) Get(ctx context.Context, key string) (*Entry, error) {
+	data, err := s.store.Get(ctx, blobKey(key))
+	if err != nil {
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil, ErrMiss
+		}
+		return nil, err
+	}
+
+	var entry Entry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cache entry: %w", err)
+	}
+
+	// Expired entries are left in place and overwritten by the next fetch
+	if !time.Now().Before(entry.ExpiresAt) {
+		return nil, ErrMiss
+	}
+
+	return &entry, nil
+}
+
+func (s *BlobStore) Put(ctx context.Context, key string, entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache entry: %w", err)
+	}
+
+	return s.store.Put(ctx, blobKey(key), data)
+}
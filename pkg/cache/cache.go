@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/blob"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ledger"
+)
+
+// MongoURI selects the MongoDB store in Open.
+const MongoURI = "mongodb"
+
+var ErrMiss = errors.New("cache miss")
+
+// Store keeps the cached entries by key.
+type Store interface {
+	// Get returns the entry or ErrMiss when it is missing or expired.
+	Get(ctx context.Context, key string) (*Entry, error)
+	Put(ctx context.Context, key string, entry *Entry) error
+}
+
+// Cache serves the responses of slow-changing endpoints without calling
+// iRacing. Only the endpoints with a TTL are cached.
+type Cache struct {
+	store Store
+	TTLs  map[string]time.Duration
+}
+
+func New(store Store, ttls map[string]time.Duration) *Cache {
+	return &Cache{
+		store: store,
+		TTLs:  ttls,
+	}
+}
+
+// Open returns the cache described by uri: "mongodb" to keep the entries in
+// db, or a blob store uri. It returns nil when uri is empty or no endpoint
+// has a TTL, which disables caching.
+func Open(ctx context.Context, uri string, db *database.DB, ttls map[string]time.Duration) (*Cache, error) {
+	if uri == "" || len(ttls) == 0 {
+		return nil, nil
+	}
+
+	if uri == MongoURI {
+		if db == nil {
+			return nil, fmt.Errorf("the response cache needs a database")
+		}
+
+		store := NewMongoStore(db)
+		err := store.EnsureIndexes(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create response cache indexes: %w", err)
+		}
+
+		return New(store, ttls), nil
+	}
+
+	blobStore, err := blob.Open(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(NewBlobStore(blobStore), ttls), nil
+}
+
+// ParseTTLs parses a comma-separated list of endpoint=duration pairs, e.g.
+// "/data/car/get=168h,/data/track/get=168h".
+//
+// freshness returns how long the responses of an endpoint stay fresh in the
+// request ledger, and false when the endpoint is unknown. A TTL must be longer
+// than the freshness, as the ledger skips the requests while it lasts and the
+// cache would never be read.
+func ParseTTLs(value string, freshness func(endpoint string) (time.Duration, bool)) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		endpoint, duration, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid cache TTL %q, expected endpoint=duration", pair)
+		}
+
+		ttl, err := time.ParseDuration(duration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache TTL of '%s': %w", endpoint, err)
+		}
+
+		fresh, ok := freshness(endpoint)
+		if !ok {
+			return nil, fmt.Errorf("invalid cache TTL of '%s': unknown endpoint", endpoint)
+		}
+		if ttl <= fresh {
+			return nil, fmt.Errorf("invalid cache TTL of '%s': %s is not longer than the freshness of %s", endpoint, ttl, fresh)
+		}
+
+		ttls[endpoint] = ttl
+	}
+
+	return ttls, nil
+}
+
+// Get returns the cached body of the request, and false when it is not
+// cached. A nil Cache never has anything.
+func (c *Cache) Get(ctx context.Context, endpoint string, params map[string]string) ([]byte, bool, error) {
+	if c == nil || c.TTLs[endpoint] <= 0 {
+		return nil, false, nil
+	}
+
+	entry, err := c.store.Get(ctx, ledger.Key(endpoint, params))
+	if err != nil {
+		if errors.Is(err, ErrMiss) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return entry.Body, true, nil
+}
+
+// Put caches the body of the request when its endpoint has a TTL. A nil
+// Cache ignores it.
+func (c *Cache) Put(ctx context.Context, endpoint string, params map[string]string, body []byte) error {
+	if c == nil {
+		return nil
+	}
+
+	ttl := c.TTLs[endpoint]
+	if ttl <= 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	return c.store.Put(ctx, ledger.Key(endpoint, params), &Entry{
+		Body:      body,
+		FetchedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+)
+
+// MongoStore keeps the cached entries in a MongoDB collection.
+type MongoStore struct {
+	db *database.DB
+}
+
+func NewMongoStore(db *database.DB) *MongoStore {
+	return &MongoStore{db: db}
+}
+
+func (s *MongoStore) collection() *mongo.Collection {
+	return s.db.DB.Collection(Collection)
+}
+
+// EnsureIndexes creates the indexes used to look up and expire entries.
+func (s *MongoStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "meta.kind", Value: 1}, {Key: "meta.name", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "status.expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+func (s *MongoStore) Get(ctx context.Context, key string) (*Entry, error) {
+	// MongoDB removes the expired entries only once a minute
+	filter := bson.M{
+		"meta.kind":         Kind,
+		"meta.name":         key,
+		"status.expires_at": bson.M{"$gt": time.Now().UTC()},
+	}
+
+	var doc CacheDoc
+	err := s.collection().FindOne(ctx, filter).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrMiss
+		}
+		return nil, err
+	}
+
+	return &Entry{
+		Body:      []byte(doc.Spec.Body),
+		FetchedAt: doc.Status.FetchedAt,
+		ExpiresAt: doc.Status.ExpiresAt,
+	}, nil
+}
+
+func (s *MongoStore) Put(ctx context.Context, key string, entry *Entry) error {
+	now := time.Now().UTC()
+
+	filter := bson.M{"meta.kind": Kind, "meta.name": key}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"meta.version":    0,
+			"meta.created_at": now,
+		},
+		"$set": bson.M{
+			"spec.body":         string(entry.Body),
+			"status.fetched_at": entry.FetchedAt,
+			"status.expires_at": entry.ExpiresAt,
+		},
+	}
+
+	_, err := s.collection().UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+	return err
+}
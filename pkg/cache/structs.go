@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+)
+
+const (
+	Collection = "response_cache"
+	Kind       = "api_response_cache"
+)
+
+// Entry is a cached response body.
+type Entry struct {
+	Body      []byte    `json:"body"`
+	FetchedAt time.Time `json:"fetched_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type CacheDoc struct {
+	Meta   database.Meta `bson:"meta,omitempty"`
+	Spec   CacheSpec     `bson:"spec,omitempty"`
+	Status CacheStatus   `bson:"status,omitempty"`
+}
+
+type CacheSpec struct {
+	Body string `bson:"body"`
+}
+
+type CacheStatus struct {
+	FetchedAt time.Time `bson:"fetched_at"`
+
+	// The entry is removed by MongoDB once expired
+	ExpiresAt time.Time `bson:"expires_at"`
+}
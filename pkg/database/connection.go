@@ -47,7 +47,7 @@ func (db *DB) GetOne(collection string, kind string, name string, result interfa
 		if err == mongo.ErrNoDocuments {
 			return ErrNotFound
 		}
-		return err
+		return classifyError(err)
 	}
 
 	return nil
@@ -59,7 +59,7 @@ func (db *DB) Create(collection string, document interface{}) error {
 		if mongo.IsDuplicateKeyError(err) {
 			return ErrDocumentExists
 		}
-		return err
+		return classifyError(err)
 	}
 
 	return nil
@@ -69,7 +69,7 @@ func (db *DB) Update(collection string, kind string, name string, version int32,
 	filter := bson.M{"meta.version": version, "meta.kind": kind, "meta.name": name}
 	result, err := db.DB.Collection(collection).ReplaceOne(db.Ctx, filter, document)
 	if err != nil {
-		return err
+		return classifyError(err)
 	}
 
 	if result.MatchedCount == 0 {
@@ -78,3 +78,57 @@ func (db *DB) Update(collection string, kind string, name string, version int32,
 
 	return nil
 }
+
+// List decodes all the documents of a kind into results, a pointer to a slice.
+func (db *DB) List(collection string, kind string, results interface{}) error {
+	filter := bson.M{"meta.kind": kind}
+	cursor, err := db.DB.Collection(collection).Find(db.Ctx, filter)
+	if err != nil {
+		return classifyError(err)
+	}
+
+	err = cursor.All(db.Ctx, results)
+	if err != nil {
+		return classifyError(err)
+	}
+
+	return nil
+}
+
+// ListByNames decodes the documents of a kind with the given names into
+// results, a pointer to a slice. Missing documents are skipped.
+func (db *DB) ListByNames(collection string, kind string, names []string, results interface{}) error {
+	filter := bson.M{"meta.kind": kind, "meta.name": bson.M{"$in": names}}
+	cursor, err := db.DB.Collection(collection).Find(db.Ctx, filter)
+	if err != nil {
+		return classifyError(err)
+	}
+
+	err = cursor.All(db.Ctx, results)
+	if err != nil {
+		return classifyError(err)
+	}
+
+	return nil
+}
+
+// ListByLabels decodes the documents of a kind matching all the labels into
+// results, a pointer to a slice.
+func (db *DB) ListByLabels(collection string, kind string, labels map[string]interface{}, results interface{}) error {
+	filter := bson.M{"meta.kind": kind}
+	for label, value := range labels {
+		filter["meta.labels."+label] = value
+	}
+
+	cursor, err := db.DB.Collection(collection).Find(db.Ctx, filter)
+	if err != nil {
+		return classifyError(err)
+	}
+
+	err = cursor.All(db.Ctx, results)
+	if err != nil {
+		return classifyError(err)
+	}
+
+	return nil
+}
@@ -1,7 +1,43 @@
 package database
 
-import "errors"
+import (
+	"errors"
+	"fmt"
 
-var ErrOptimisticLock = errors.New("document modified by another process")
+	"go.mongodb.org/mongo-driver/v2/mongo"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+var ErrOptimisticLock = fmt.Errorf("document modified by another process: %w", failure.ErrRetryable)
 var ErrNotFound = errors.New("document not found")
-var ErrDocumentExists = errors.New("document already exists")
+var ErrDocumentExists = fmt.Errorf("document already exists: %w", failure.ErrRetryable)
+
+// Server error codes that will never succeed on retry
+var permanentErrorCodes = map[int]struct{}{
+	2:     {}, // BadValue
+	10334: {}, // BSONObjectTooLarge
+	17419: {}, // Resulting document after update is larger than the maximum size
+}
+
+// classifyError tags a MongoDB error with its failure category.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if mongo.IsTimeout(err) || mongo.IsNetworkError(err) {
+		return failure.Retryable(err)
+	}
+
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		for code := range permanentErrorCodes {
+			if serverErr.HasErrorCode(code) {
+				return failure.Permanent(err)
+			}
+		}
+	}
+
+	return failure.Retryable(err)
+}
@@ -0,0 +1,258 @@
+package deadletter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+)
+
+const (
+	DefaultMaxAttempts = 5
+
+	// Rate-limit and authentication failures are retried many more times, as they are not the fault of the message
+	DefaultMaxThrottledAttempts = 50
+
+	// How long the attempt history of a message that is still being retried is kept
+	retryingTTL = 7 * 24 * time.Hour
+)
+
+// Queue records failed deliveries in MongoDB and decides when a message must
+// stop being retried.
+type Queue struct {
+	db                   *database.DB
+	MaxAttempts          int
+	MaxThrottledAttempts int
+}
+
+func NewQueue(db *database.DB, maxAttempts int) *Queue {
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	return &Queue{
+		db:                   db,
+		MaxAttempts:          maxAttempts,
+		MaxThrottledAttempts: DefaultMaxThrottledAttempts,
+	}
+}
+
+func (q *Queue) collection() *mongo.Collection {
+	return q.db.DB.Collection(Collection)
+}
+
+// EnsureIndexes creates the indexes used to look up and expire entries.
+func (q *Queue) EnsureIndexes(ctx context.Context) error {
+	_, err := q.collection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "meta.kind", Value: 1}, {Key: "meta.name", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "status.expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// Fail records a failed delivery of msg. It returns true when the message
+// reached the maximum number of attempts and was moved to the dead letters,
+// in which case it must be acknowledged instead of retried.
+func (q *Queue) Fail(ctx context.Context, msgType string, msg *bus.Message, cause error) (bool, error) {
+	if q == nil || msg.ID == "" {
+		return false, nil
+	}
+
+	attempts, _, err := q.record(ctx, msgType, msg, cause, false)
+	if err != nil {
+		return false, err
+	}
+
+	if attempts < q.MaxAttempts {
+		return false, nil
+	}
+
+	err = q.kill(ctx, msg.ID)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Message %s dead-lettered after %d attempts: %v", msg.ID, attempts, cause)
+
+	return true, nil
+}
+
+// Throttled records a delivery of msg rejected by a rate limit or an
+// authentication failure. These do not count against MaxAttempts, but a
+// message throttled MaxThrottledAttempts times is moved to the dead letters
+// and Throttled returns true, so that it stops looping.
+func (q *Queue) Throttled(ctx context.Context, msgType string, msg *bus.Message, cause error) (bool, error) {
+	if q == nil || msg.ID == "" {
+		return false, nil
+	}
+
+	_, throttled, err := q.record(ctx, msgType, msg, cause, true)
+	if err != nil {
+		return false, err
+	}
+
+	if throttled < q.MaxThrottledAttempts {
+		return false, nil
+	}
+
+	err = q.kill(ctx, msg.ID)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Message %s dead-lettered after %d throttled attempts: %v", msg.ID, throttled, cause)
+
+	return true, nil
+}
+
+// Bury moves msg to the dead letters straight away, for failures that will
+// never succeed on retry.
+func (q *Queue) Bury(ctx context.Context, msgType string, msg *bus.Message, cause error) error {
+	if q == nil || msg.ID == "" {
+		return nil
+	}
+
+	_, _, err := q.record(ctx, msgType, msg, cause, false)
+	if err != nil {
+		return err
+	}
+
+	err = q.kill(ctx, msg.ID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Message %s dead-lettered after a permanent failure: %v", msg.ID, cause)
+
+	return nil
+}
+
+// record appends the failed attempt to the history of msg and returns the
+// number of attempts so far, apart from the throttled ones, and the number of
+// throttled attempts.
+func (q *Queue) record(ctx context.Context, msgType string, msg *bus.Message, cause error, throttled bool) (int, int, error) {
+	// Store the decoded data so that it can be read and edited
+	data := msg.Data
+	attributes := maps.Clone(msg.Attributes)
+	decoded, err := bus.DecodeMessageData(msg.Data, msg.Attributes)
+	if err == nil {
+		data = decoded
+		delete(attributes, bus.EncodingAttribute)
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(retryingTTL)
+
+	labels := map[string]interface{}{}
+	if endpoint, ok := msg.Attributes["endpoint"]; ok {
+		labels["endpoint"] = endpoint
+	}
+
+	filter := bson.M{"meta.kind": Kind, "meta.name": msg.ID}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"meta.version":    0,
+			"meta.created_at": now,
+			"meta.labels":     labels,
+			"spec": DeadLetterSpec{
+				Type:       msgType,
+				Data:       string(data),
+				Attributes: attributes,
+			},
+		},
+		"$set": bson.M{
+			"status.state":      StateRetrying,
+			"status.expires_at": expiresAt,
+		},
+		"$push": bson.M{
+			"status.attempts": DeadLetterAttempt{At: now, Error: cause.Error(), Throttled: throttled},
+		},
+	}
+
+	var doc DeadLetterDoc
+	err = q.collection().FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to record delivery attempt: %w", err)
+	}
+
+	attempts, throttledAttempts := 0, 0
+	for _, attempt := range doc.Status.Attempts {
+		if attempt.Throttled {
+			throttledAttempts++
+		} else {
+			attempts++
+		}
+	}
+
+	return attempts, throttledAttempts, nil
+}
+
+func (q *Queue) kill(ctx context.Context, id string) error {
+	filter := bson.M{"meta.kind": Kind, "meta.name": id}
+	_, err := q.collection().UpdateOne(ctx, filter, bson.M{
+		"$set":   bson.M{"status.state": StateDead},
+		"$unset": bson.M{"status.expires_at": ""},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter message: %w", err)
+	}
+
+	return nil
+}
+
+// List returns the entries in the given state, most recent first.
+func (q *Queue) List(ctx context.Context, state string, limit int64) ([]DeadLetterDoc, error) {
+	filter := bson.M{"meta.kind": Kind}
+	if state != "" {
+		filter["status.state"] = state
+	}
+
+	cursor, err := q.collection().Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "meta.created_at", Value: -1}}).
+		SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []DeadLetterDoc
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return nil, err
+	}
+
+	return docs, nil
+}
+
+func (q *Queue) Get(id string) (*DeadLetterDoc, error) {
+	var doc DeadLetterDoc
+
+	err := q.db.GetOne(Collection, Kind, id, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+func (q *Queue) Save(doc *DeadLetterDoc) error {
+	doc.Meta.Version += 1
+	return q.db.Update(Collection, Kind, doc.Meta.Name, doc.Meta.Version-1, doc)
+}
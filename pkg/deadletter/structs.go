@@ -0,0 +1,48 @@
+package deadletter
+
+import (
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+)
+
+const (
+	Collection = "dead_letters"
+	Kind       = "dead_letter"
+
+	// Type of the dead-lettered message, used to pick the replay topic
+	TypeApiRequest  = "api_request"
+	TypeApiResponse = "api_response"
+
+	StateRetrying = "retrying"
+	StateDead     = "dead"
+	StateReplayed = "replayed"
+)
+
+type DeadLetterDoc struct {
+	Meta   database.Meta    `bson:"meta,omitempty"`
+	Spec   DeadLetterSpec   `bson:"spec,omitempty"`
+	Status DeadLetterStatus `bson:"status,omitempty"`
+}
+
+type DeadLetterSpec struct {
+	Type       string            `bson:"type"`
+	Data       string            `bson:"data"`
+	Attributes map[string]string `bson:"attributes,omitempty"`
+}
+
+type DeadLetterStatus struct {
+	State    string              `bson:"state"`
+	Attempts []DeadLetterAttempt `bson:"attempts,omitempty"`
+
+	// Only set while retrying, so that messages that eventually succeed are cleaned up
+	ExpiresAt *time.Time `bson:"expires_at,omitempty"`
+}
+
+type DeadLetterAttempt struct {
+	At    time.Time `bson:"at"`
+	Error string    `bson:"error"`
+
+	// Rejected by a rate limit or an authentication failure, counted apart from the other failures
+	Throttled bool `bson:"throttled,omitempty"`
+}
@@ -0,0 +1,272 @@
+package drift
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Change kinds
+const (
+	// The payload has a field the type does not know
+	ChangeUnknown = "unknown"
+
+	// The type has a field the payload does not send
+	ChangeMissing = "missing"
+
+	// The payload sends a field with a value the type cannot decode, e.g. a string for a number
+	ChangeMismatched = "mismatched"
+)
+
+var unmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+
+// Changes are the fields in which a payload differs from the type it decodes
+// into, as paths like session_results[].results[].cust_id.
+type Changes struct {
+	Unknown    []string
+	Missing    []string
+	Mismatched []string
+}
+
+func (c *Changes) Empty() bool {
+	return c == nil || len(c.Unknown) == 0 && len(c.Missing) == 0 && len(c.Mismatched) == 0
+}
+
+// Compare returns the fields in which the JSON payload differs from t.
+// Fields tagged omitempty are never missing, and the content of the types
+// decoding themselves, such as dates, and of the fields tagged string is not
+// compared.
+func Compare(data []byte, t reflect.Type) (*Changes, error) {
+	var value interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &comparison{
+		unknown:    make(map[string]bool),
+		missing:    make(map[string]bool),
+		mismatched: make(map[string]bool),
+	}
+	c.compare(value, t, "")
+
+	return &Changes{
+		Unknown:    sortedKeys(c.unknown),
+		Missing:    sortedKeys(c.missing),
+		Mismatched: sortedKeys(c.mismatched),
+	}, nil
+}
+
+// Without drops the paths from the changes, e.g. the fields filled by the
+// client rather than sent by iRacing.
+func (c *Changes) Without(paths ...string) *Changes {
+	drop := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		drop[path] = true
+	}
+
+	filter := func(paths []string) []string {
+		var kept []string
+		for _, path := range paths {
+			if !drop[path] {
+				kept = append(kept, path)
+			}
+		}
+		return kept
+	}
+
+	return &Changes{
+		Unknown:    filter(c.Unknown),
+		Missing:    filter(c.Missing),
+		Mismatched: filter(c.Mismatched),
+	}
+}
+
+type comparison struct {
+	unknown    map[string]bool
+	missing    map[string]bool
+	mismatched map[string]bool
+}
+
+type field struct {
+	typ       reflect.Type
+	omitEmpty bool
+
+	// Tagged string, the value is encoded in a JSON string
+	quoted bool
+}
+
+func (c *comparison) compare(value interface{}, t reflect.Type, path string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if value == nil || reflect.PointerTo(t).Implements(unmarshalerType) {
+		return
+	}
+
+	if !fits(value, t) {
+		c.mismatched[path] = true
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		fields := make(map[string]field)
+		jsonFields(t, fields)
+
+		for name, f := range fields {
+			fieldValue, ok := object[name]
+			if !ok {
+				if !f.omitEmpty {
+					c.missing[join(path, name)] = true
+				}
+				continue
+			}
+
+			if f.quoted {
+				continue
+			}
+
+			c.compare(fieldValue, f.typ, join(path, name))
+		}
+
+		for name := range object {
+			if _, ok := fields[name]; !ok {
+				c.unknown[join(path, name)] = true
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		items, ok := value.([]interface{})
+		if !ok {
+			return
+		}
+
+		for _, item := range items {
+			c.compare(item, t.Elem(), path+"[]")
+		}
+
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		for _, item := range object {
+			c.compare(item, t.Elem(), path+".*")
+		}
+	}
+}
+
+// jsonFields collects the fields of a struct by JSON name, including the ones
+// of its embedded structs.
+func jsonFields(t reflect.Type, fields map[string]field) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			jsonFields(f.Type, fields)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		fields[name] = field{
+			typ:       f.Type,
+			omitEmpty: strings.Contains(","+options+",", ",omitempty,"),
+			quoted:    strings.Contains(","+options+",", ",string,"),
+		}
+	}
+}
+
+// fits returns true when the decoded JSON value can be decoded into t.
+func fits(value interface{}, t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		_, ok := value.(map[string]interface{})
+		return ok
+
+	case reflect.Slice:
+		// Byte slices are sent as base64 strings
+		if _, ok := value.(string); ok && t.Elem().Kind() == reflect.Uint8 {
+			return true
+		}
+		_, ok := value.([]interface{})
+		return ok
+
+	case reflect.Array:
+		_, ok := value.([]interface{})
+		return ok
+
+	case reflect.Bool:
+		_, ok := value.(bool)
+		return ok
+
+	case reflect.String:
+		_, ok := value.(string)
+		return ok
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := strconv.ParseInt(number.String(), 10, t.Bits())
+		return err == nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := strconv.ParseUint(number.String(), 10, t.Bits())
+		return err == nil
+
+	case reflect.Float32, reflect.Float64:
+		_, ok := value.(json.Number)
+		return ok
+
+	default:
+		return true
+	}
+}
+
+func join(path string, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,120 @@
+package drift
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+type testResult struct {
+	CustID    int64     `json:"cust_id"`
+	Name      string    `json:"display_name"`
+	Laps      []int64   `json:"laps"`
+	CarNumber *string   `json:"car_number,omitempty"`
+	Interval  int64     `json:"interval,string"`
+	StartTime time.Time `json:"start_time"`
+}
+
+type testSession struct {
+	SubsessionID int64              `json:"subsession_id"`
+	Results      []testResult       `json:"results"`
+	Weather      map[string]float64 `json:"weather"`
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Changes
+	}{
+		{
+			name: "matching payload",
+			data: `{"subsession_id": 1, "weather": {"temp": 21.5}, "results": [
+				{"cust_id": 100001, "display_name": "Marco Rossi", "laps": [1, 2], "interval": "12", "start_time": "2025-01-01T20:00:00Z"}
+			]}`,
+		},
+		{
+			name: "unknown fields",
+			data: `{"subsession_id": 1, "weather": {}, "results": [
+				{"cust_id": 100001, "display_name": "Marco Rossi", "laps": [], "interval": "0", "start_time": "2025-01-01T20:00:00Z", "flair_id": 110}
+			], "league_id": 4403}`,
+			want: Changes{Unknown: []string{"league_id", "results[].flair_id"}},
+		},
+		{
+			name: "missing fields",
+			data: `{"subsession_id": 1, "results": [
+				{"cust_id": 100001, "laps": [], "interval": "0", "start_time": "2025-01-01T20:00:00Z"}
+			]}`,
+			want: Changes{Missing: []string{"results[].display_name", "weather"}},
+		},
+		{
+			name: "mismatched fields",
+			data: `{"subsession_id": "1", "weather": {"temp": "warm"}, "results": [
+				{"cust_id": 1.5, "display_name": 7, "laps": {}, "interval": "0", "start_time": "2025-01-01T20:00:00Z"}
+			]}`,
+			want: Changes{Mismatched: []string{
+				"results[].cust_id",
+				"results[].display_name",
+				"results[].laps",
+				"subsession_id",
+				"weather.*",
+			}},
+		},
+		{
+			name: "null values",
+			data: `{"subsession_id": null, "weather": null, "results": [
+				{"cust_id": 100001, "display_name": null, "laps": null, "car_number": null, "interval": "0", "start_time": null}
+			]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Compare([]byte(tt.data), reflect.TypeFor[testSession]())
+			if err != nil {
+				t.Fatalf("Compare() error = %v", err)
+			}
+
+			if !slices.Equal(got.Unknown, tt.want.Unknown) {
+				t.Errorf("Unknown = %v, want %v", got.Unknown, tt.want.Unknown)
+			}
+			if !slices.Equal(got.Missing, tt.want.Missing) {
+				t.Errorf("Missing = %v, want %v", got.Missing, tt.want.Missing)
+			}
+			if !slices.Equal(got.Mismatched, tt.want.Mismatched) {
+				t.Errorf("Mismatched = %v, want %v", got.Mismatched, tt.want.Mismatched)
+			}
+			if got.Empty() != tt.want.Empty() {
+				t.Errorf("Empty() = %v, want %v", got.Empty(), tt.want.Empty())
+			}
+		})
+	}
+}
+
+func TestCompareInvalidJSON(t *testing.T) {
+	_, err := Compare([]byte(`{"subsession_id": `), reflect.TypeFor[testSession]())
+	if err == nil {
+		t.Error("Compare() of a truncated payload returned no error")
+	}
+}
+
+func TestChangesWithout(t *testing.T) {
+	changes := &Changes{
+		Unknown:    []string{"league_id", "results[].flair_id"},
+		Missing:    []string{"weather"},
+		Mismatched: []string{"subsession_id"},
+	}
+
+	got := changes.Without("results[].flair_id", "weather")
+
+	if !slices.Equal(got.Unknown, []string{"league_id"}) {
+		t.Errorf("Unknown = %v, want [league_id]", got.Unknown)
+	}
+	if len(got.Missing) != 0 {
+		t.Errorf("Missing = %v, want none", got.Missing)
+	}
+	if !slices.Equal(got.Mismatched, []string{"subsession_id"}) {
+		t.Errorf("Mismatched = %v, want [subsession_id]", got.Mismatched)
+	}
+}
@@ -0,0 +1,106 @@
+package drift
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+)
+
+// Report keeps one entry per endpoint and changed field, counting the
+// responses in which the change was seen.
+type Report struct {
+	db *database.DB
+}
+
+func NewReport(db *database.DB) *Report {
+	return &Report{db: db}
+}
+
+func (r *Report) collection() *mongo.Collection {
+	return r.db.DB.Collection(Collection)
+}
+
+// EnsureIndexes creates the index used to look up the entries.
+func (r *Report) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "meta.kind", Value: 1}, {Key: "meta.name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// Record adds the changes of a response of endpoint to the report. A nil
+// Report ignores them.
+func (r *Report) Record(ctx context.Context, endpoint string, messageID string, changes *Changes) error {
+	if r == nil || changes.Empty() {
+		return nil
+	}
+
+	now := time.Now().UTC()
+
+	var models []mongo.WriteModel
+	for _, change := range []struct {
+		kind   string
+		fields []string
+	}{
+		{ChangeUnknown, changes.Unknown},
+		{ChangeMissing, changes.Missing},
+		{ChangeMismatched, changes.Mismatched},
+	} {
+		for _, field := range change.fields {
+			name := endpoint + " " + change.kind + " " + field
+
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"meta.kind": Kind, "meta.name": name}).
+				SetUpdate(bson.M{
+					"$setOnInsert": bson.M{
+						"meta.version":         0,
+						"meta.created_at":      now,
+						"meta.labels.endpoint": endpoint,
+						"spec.endpoint":        endpoint,
+						"spec.change":          change.kind,
+						"spec.field":           field,
+						"status.first_seen_at": now,
+					},
+					"$inc": bson.M{"status.count": 1},
+					"$set": bson.M{
+						"status.last_seen_at":    now,
+						"status.last_message_id": messageID,
+					},
+				}).
+				SetUpsert(true))
+		}
+	}
+
+	_, err := r.collection().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// List returns the entries of endpoint, or of every endpoint when empty,
+// most recently seen first.
+func (r *Report) List(ctx context.Context, endpoint string) ([]DriftDoc, error) {
+	filter := bson.M{"meta.kind": Kind}
+	if endpoint != "" {
+		filter["spec.endpoint"] = endpoint
+	}
+
+	cursor, err := r.collection().Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "status.last_seen_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []DriftDoc
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return nil, err
+	}
+
+	return docs, nil
+}
@@ -0,0 +1,34 @@
+package drift
+
+import (
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+)
+
+const (
+	Collection = "schema_drift"
+	Kind       = "schema_drift"
+)
+
+type DriftDoc struct {
+	Meta   database.Meta `bson:"meta,omitempty"`
+	Spec   DriftSpec     `bson:"spec,omitempty"`
+	Status DriftStatus   `bson:"status,omitempty"`
+}
+
+type DriftSpec struct {
+	Endpoint string `bson:"endpoint"`
+	Change   string `bson:"change"`
+	Field    string `bson:"field"`
+}
+
+type DriftStatus struct {
+	// Responses in which the change was seen
+	Count       int       `bson:"count"`
+	FirstSeenAt time.Time `bson:"first_seen_at"`
+	LastSeenAt  time.Time `bson:"last_seen_at"`
+
+	// Last message whose response had the change, to find it in the archive
+	LastMessageID string `bson:"last_message_id,omitempty"`
+}
@@ -0,0 +1,97 @@
+package failure
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Categories of failure, checked with errors.Is. Errors carrying none of them
+// are considered retryable.
+var (
+	ErrPermanent   = errors.New("permanent failure")
+	ErrRetryable   = errors.New("retryable failure")
+	ErrRateLimited = errors.New("rate limited")
+	ErrAuth        = errors.New("authentication failure")
+	ErrDeferred    = errors.New("deferred")
+)
+
+func Permanent(err error) error {
+	return fmt.Errorf("%w: %w", ErrPermanent, err)
+}
+
+func Retryable(err error) error {
+	return fmt.Errorf("%w: %w", ErrRetryable, err)
+}
+
+func Auth(err error) error {
+	return fmt.Errorf("%w: %w", ErrAuth, err)
+}
+
+// RateLimitError is a rate-limit failure that knows when the limit resets.
+type RateLimitError struct {
+	Reset time.Time
+	Err   error
+}
+
+func RateLimited(reset time.Time, err error) error {
+	return &RateLimitError{Reset: reset, Err: err}
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v until %s: %v", ErrRateLimited, e.Reset.Format(time.RFC3339), e.Err)
+}
+
+func (e *RateLimitError) Unwrap() []error {
+	return []error{ErrRateLimited, e.Err}
+}
+
+// DeferredError reports a message that must not be handled before Until.
+type DeferredError struct {
+	Until time.Time
+	Err   error
+}
+
+func Deferred(until time.Time, err error) error {
+	return &DeferredError{Until: until, Err: err}
+}
+
+func (e *DeferredError) Error() string {
+	return fmt.Sprintf("%v until %s: %v", ErrDeferred, e.Until.Format(time.RFC3339), e.Err)
+}
+
+func (e *DeferredError) Unwrap() []error {
+	return []error{ErrDeferred, e.Err}
+}
+
+// Classify returns the category sentinel of err.
+func Classify(err error) error {
+	switch {
+	case errors.Is(err, ErrDeferred):
+		return ErrDeferred
+	case errors.Is(err, ErrAuth):
+		return ErrAuth
+	case errors.Is(err, ErrRateLimited):
+		return ErrRateLimited
+	case errors.Is(err, ErrPermanent):
+		return ErrPermanent
+	default:
+		return ErrRetryable
+	}
+}
+
+// RetryAfter returns how long to wait before retrying after err, or zero when
+// an immediate retry is fine.
+func RetryAfter(err error) time.Duration {
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return max(time.Until(rateLimitErr.Reset), 0)
+	}
+
+	var deferredErr *DeferredError
+	if errors.As(err, &deferredErr) {
+		return max(time.Until(deferredErr.Until), 0)
+	}
+
+	return 0
+}
@@ -0,0 +1,63 @@
+package fakeiracing
+
+import (
+	"embed"
+	"io/fs"
+	"net/url"
+	"strings"
+)
+
+//go:embed fixtures
+var embedded embed.FS
+
+// Fixtures are the recorded responses of a small league season: two sessions,
+// the second one purged by iRacing, and the chunked laps of the drivers of
+// the first one, with the cars, car classes, tracks and drivers they refer to.
+var Fixtures fs.FS
+
+func init() {
+	var err error
+	Fixtures, err = fs.Sub(embedded, "fixtures")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Parameters identifying the fixture of a response, in the order they appear
+// in its file name. The other parameters, e.g. include_licenses, are ignored.
+var fixtureParams = map[string][]string{
+	"/data/league/get":              {"league_id"},
+	"/data/league/season_sessions":  {"league_id", "season_id"},
+	"/data/league/season_standings": {"league_id", "season_id", "car_class_id"},
+	"/data/league/seasons":          {"league_id"},
+	"/data/member/get":              {"cust_ids"},
+	"/data/car/get":                 {},
+	"/data/carclass/get":            {},
+	"/data/results/get":             {"subsession_id"},
+	"/data/results/lap_data":        {"subsession_id", "simsession_number", "cust_id"},
+	"/data/track/get":               {},
+	"/data/track/assets":            {},
+}
+
+// fixtureKey returns the path of the fixture of a request without extension,
+// e.g. results/lap_data/70000001_0_100001, or car/get for the endpoints
+// without identifying params. The body is stored in <key>.json and
+// the rows of the chunked responses in <key>.chunk<n>.json.
+func fixtureKey(endpoint string, query url.Values) (string, bool) {
+	names, ok := fixtureParams[endpoint]
+	if !ok {
+		return "", false
+	}
+
+	key := strings.TrimPrefix(endpoint, "/data/")
+	if len(names) == 0 {
+		return key, true
+	}
+
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = query.Get(name)
+	}
+
+	return key + "/" + strings.Join(values, "_"), true
+}
@@ -0,0 +1,400 @@
+package fakeiracing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/riccardotornesello/irapi-go"
+	"github.com/riccardotornesello/irapi-go/pkg/client"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/iracing"
+)
+
+const (
+	// Same budget as an iRacing account
+	DefaultRateLimit  = 240
+	DefaultRateWindow = time.Minute
+
+	// Lifetime of the signed payload and chunk links
+	DefaultLinkTTL = 10 * time.Minute
+
+	// Lifetime of the issued access and refresh tokens
+	accessTokenTTL  = time.Hour
+	refreshTokenTTL = 24 * time.Hour
+)
+
+// Handler serves the fixtures like the iRacing data API: an authenticated
+// call returns a signed link to the payload, and the chunked payloads link to
+// signed chunk files. It also serves the token endpoint of the iRacing
+// authentication API, accepting any credentials.
+type Handler struct {
+	fixtures fs.FS
+	secret   []byte
+	mux      *http.ServeMux
+
+	RateLimit  int
+	RateWindow time.Duration
+	LinkTTL    time.Duration
+
+	mu          sync.Mutex
+	tokens      map[string]bool
+	windowStart time.Time
+	used        int
+	calls       map[string]int
+}
+
+// NewHandler serves the fixtures of fixtures, or the recorded Fixtures when nil.
+func NewHandler(fixtures fs.FS) *Handler {
+	if fixtures == nil {
+		fixtures = Fixtures
+	}
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	h := &Handler{
+		fixtures:   fixtures,
+		secret:     secret,
+		mux:        http.NewServeMux(),
+		RateLimit:  DefaultRateLimit,
+		RateWindow: DefaultRateWindow,
+		LinkTTL:    DefaultLinkTTL,
+		tokens:     make(map[string]bool),
+		calls:      make(map[string]int),
+	}
+
+	h.mux.HandleFunc("POST /oauth2/token", h.token)
+	h.mux.HandleFunc("GET /data/", h.data)
+	h.mux.HandleFunc("GET /links/", h.link)
+	h.mux.HandleFunc("GET /chunks/", h.chunk)
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Calls returns the number of data API calls made to endpoint, including the
+// rejected ones.
+func (h *Handler) Calls(endpoint string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.calls[endpoint]
+}
+
+// RevokeTokens invalidates every issued token, so the next calls are rejected
+// until the client logs in again.
+func (h *Handler) RevokeTokens() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.tokens = make(map[string]bool)
+}
+
+// token issues a new token pair, for both the password and the refresh grants.
+func (h *Handler) token(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "password_limited":
+		if r.PostForm.Get("username") == "" || r.PostForm.Get("password") == "" {
+			writeError(w, http.StatusUnauthorized, "invalid_grant", "missing credentials")
+			return
+		}
+
+	case "refresh_token":
+		if !h.validToken(r.PostForm.Get("refresh_token")) {
+			writeError(w, http.StatusUnauthorized, "invalid_grant", "unknown refresh token")
+			return
+		}
+
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type", r.PostForm.Get("grant_type"))
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"access_token":             h.issueToken(accessTokenTTL),
+		"token_type":               "Bearer",
+		"expires_in":               int(accessTokenTTL.Seconds()),
+		"refresh_token":            h.issueToken(refreshTokenTTL),
+		"refresh_token_expires_in": int(refreshTokenTTL.Seconds()),
+	})
+}
+
+// data answers an API call with a signed link to the payload of its fixture.
+func (h *Handler) data(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.calls[r.URL.Path]++
+	h.mu.Unlock()
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !h.validToken(token) {
+		writeError(w, http.StatusUnauthorized, "Unauthorized", "Invalid or expired access token")
+		return
+	}
+
+	if !h.take(w) {
+		writeError(w, http.StatusTooManyRequests, "Too Many Requests", "Rate limit exceeded")
+		return
+	}
+
+	key, ok := fixtureKey(r.URL.Path, r.URL.Query())
+	if !ok || !h.exists(key+".json") {
+		writeError(w, http.StatusNotFound, "Not Found", fmt.Sprintf("No data found for %s", r.URL.Path))
+		return
+	}
+
+	linkPath := "/links/" + key + ".json"
+	expires := time.Now().Add(h.LinkTTL)
+	writeJSON(w, map[string]interface{}{
+		"link":    baseURL(r) + linkPath + h.sign(linkPath, expires),
+		"expires": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// link serves a payload, pointing its chunk info to signed chunk links.
+func (h *Handler) link(w http.ResponseWriter, r *http.Request) {
+	if !h.verify(r) {
+		writeAccessDenied(w)
+		return
+	}
+
+	key := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/links/"), ".json")
+
+	body, err := fs.ReadFile(h.fixtures, key+".json")
+	if err != nil {
+		writeAccessDenied(w)
+		return
+	}
+
+	body, err = h.linkChunks(r, key, body)
+	if err != nil {
+		log.Printf("Failed to link the chunks of fixture %s: %v", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// linkChunks fills the chunk info of a chunked payload with signed links to
+// its chunk files. Other payloads are returned as they are.
+func (h *Handler) linkChunks(r *http.Request, key string, body []byte) ([]byte, error) {
+	var payload map[string]json.RawMessage
+	if json.Unmarshal(body, &payload) != nil || payload["chunk_info"] == nil {
+		return body, nil
+	}
+
+	var chunkInfo client.IRacingChunkInfo
+	err := json.Unmarshal(payload["chunk_info"], &chunkInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(h.LinkTTL)
+	chunkInfo.BaseDownloadUrl = baseURL(r) + "/chunks/" + key + "/"
+	chunkInfo.ChunkFileNames = make([]string, chunkInfo.NumChunks)
+	for i := range chunkInfo.ChunkFileNames {
+		name := fmt.Sprintf("%d.json", i)
+		chunkInfo.ChunkFileNames[i] = name + h.sign("/chunks/"+key+"/"+name, expires)
+	}
+
+	payload["chunk_info"], err = json.Marshal(chunkInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(payload)
+}
+
+// chunk serves the rows of a chunk file.
+func (h *Handler) chunk(w http.ResponseWriter, r *http.Request) {
+	if !h.verify(r) {
+		writeAccessDenied(w)
+		return
+	}
+
+	dir, name := path.Split(strings.TrimPrefix(r.URL.Path, "/chunks/"))
+	key := strings.TrimSuffix(dir, "/")
+
+	body, err := fs.ReadFile(h.fixtures, key+".chunk"+name)
+	if err != nil {
+		writeAccessDenied(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// take spends a call of the rate-limit budget and sets the rate-limit headers.
+func (h *Handler) take(w http.ResponseWriter) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.windowStart) >= h.RateWindow {
+		h.windowStart = now
+		h.used = 0
+	}
+
+	h.used++
+	remaining := h.RateLimit - h.used
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(h.RateLimit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(max(remaining, 0)))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(h.windowStart.Add(h.RateWindow).Unix(), 10))
+
+	return remaining >= 0
+}
+
+func (h *Handler) exists(name string) bool {
+	_, err := fs.Stat(h.fixtures, name)
+	return err == nil
+}
+
+// issueToken returns a new JWT, signed with a random signature, that the
+// iRacing client can read the expiry of.
+func (h *Handler) issueToken(ttl time.Duration) string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	signature := make([]byte, 32)
+	rand.Read(signature)
+
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"jti": hex.EncodeToString(id),
+		"exp": time.Now().Add(ttl).Unix(),
+	})
+
+	token := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString(header),
+		base64.RawURLEncoding.EncodeToString(claims),
+		base64.RawURLEncoding.EncodeToString(signature),
+	}, ".")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.tokens[token] = true
+	return token
+}
+
+func (h *Handler) validToken(token string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.tokens[token]
+}
+
+// sign returns the query string with the expiry and signature of the link to path.
+func (h *Handler) sign(path string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return "?expires=" + exp + "&signature=" + h.signature(path, exp)
+}
+
+// verify checks the signature and expiry of a link.
+func (h *Handler) verify(r *http.Request) bool {
+	exp := r.URL.Query().Get("expires")
+	signature := r.URL.Query().Get("signature")
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(h.signature(r.URL.Path, exp)))
+}
+
+func (h *Handler) signature(path string, exp string) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(path + "\n" + exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Server is a fake iRacing API listening on a local address. The iRacing
+// client only talks to the real hosts, so they must be redirected to URL,
+// see iracing.RedirectAPI.
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts a server serving the fixtures of fixtures, or the recorded
+// Fixtures when nil. The caller should call Close when finished.
+func NewServer(fixtures fs.FS) *Server {
+	handler := NewHandler(fixtures)
+
+	return &Server{
+		Server:  httptest.NewServer(handler),
+		Handler: handler,
+	}
+}
+
+// Credentials are placeholder credentials, which the fake servers accept.
+var Credentials = iracing.Credentials{
+	Name:         "fake",
+	ClientID:     "fake-client",
+	ClientSecret: "fake-secret",
+	Username:     "fake@example.com",
+	Password:     "fake-password",
+}
+
+// Login logs in with the placeholder Credentials. The iRacing API must be
+// redirected to a fake server, see iracing.RedirectAPI.
+func Login() (*irapi.IRacingApiClient, error) {
+	return Credentials.Login(http.DefaultTransport)
+}
+
+// baseURL returns the URL the request was sent to, used by the links.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, error string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":   error,
+		"message": message,
+	})
+}
+
+// writeAccessDenied answers an invalid or expired link like the storage
+// bucket behind the iRacing links.
+func writeAccessDenied(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+}
@@ -0,0 +1,194 @@
+package fakeiracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/fakeiracing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/iracing"
+)
+
+const responseTopicID = "api-res"
+
+// newHandler returns an API handler logged in to the server, publishing the
+// responses to the bus, without any of the components needing a database.
+func newHandler(t *testing.T, server *fakeiracing.Server, memoryBus *bus.MemoryBus) *iracing.Handler {
+	t.Helper()
+
+	err := iracing.RedirectAPI(server.URL)
+	if err != nil {
+		t.Fatalf("failed to redirect the iRacing API: %v", err)
+	}
+
+	accountPool := iracing.NewPool([]iracing.Credentials{fakeiracing.Credentials}, nil)
+
+	err = accountPool.Login()
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+
+	return &iracing.Handler{
+		Accounts:  accountPool,
+		Publisher: memoryBus.Publisher(responseTopicID),
+	}
+}
+
+// responses returns the responses published so far.
+func responses(t *testing.T, memoryBus *bus.MemoryBus) []bus.ApiResponse {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var apiResponses []bus.ApiResponse
+	memoryBus.Subscriber(responseTopicID).Receive(ctx, func(ctx context.Context, msg *bus.Message) {
+		var apiResponse bus.ApiResponse
+		err := json.Unmarshal(msg.Data, &apiResponse)
+		if err != nil {
+			t.Errorf("invalid response message: %v", err)
+		}
+		apiResponses = append(apiResponses, apiResponse)
+		msg.Ack()
+	})
+
+	return apiResponses
+}
+
+func TestHandlerSeasonSessions(t *testing.T) {
+	server := fakeiracing.NewServer(nil)
+	defer server.Close()
+
+	memoryBus := bus.NewMemoryBus()
+	handler := newHandler(t, server, memoryBus)
+
+	err := handler.HandleApiRequest(context.Background(), &bus.ApiRequest{
+		Endpoint: "/data/league/season_sessions",
+		Params: map[string]string{
+			"league_id":    "4403",
+			"season_id":    "111025",
+			"results_only": "true",
+		},
+	})
+	if err != nil {
+		t.Fatalf("HandleApiRequest() error = %v", err)
+	}
+
+	apiResponses := responses(t, memoryBus)
+	if len(apiResponses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(apiResponses))
+	}
+
+	var body struct {
+		Sessions []struct {
+			SubsessionID int64 `json:"subsession_id"`
+		} `json:"sessions"`
+	}
+	err = json.Unmarshal([]byte(apiResponses[0].Body), &body)
+	if err != nil {
+		t.Fatalf("invalid response body: %v", err)
+	}
+	if len(body.Sessions) != 2 {
+		t.Errorf("response has %d sessions, want 2", len(body.Sessions))
+	}
+}
+
+func TestHandlerChunkedLapData(t *testing.T) {
+	server := fakeiracing.NewServer(nil)
+	defer server.Close()
+
+	memoryBus := bus.NewMemoryBus()
+	handler := newHandler(t, server, memoryBus)
+
+	err := handler.HandleApiRequest(context.Background(), &bus.ApiRequest{
+		Endpoint: "/data/results/lap_data",
+		Params: map[string]string{
+			"subsession_id":     "70000001",
+			"simsession_number": "0",
+			"cust_id":           "100001",
+		},
+	})
+	if err != nil {
+		t.Fatalf("HandleApiRequest() error = %v", err)
+	}
+
+	apiResponses := responses(t, memoryBus)
+	if len(apiResponses) != 1 {
+		t.Fatalf("published %d responses, want 1", len(apiResponses))
+	}
+	if apiResponses[0].Chunks == nil {
+		t.Fatal("lap data response has no chunks")
+	}
+
+	var chunkInfo struct {
+		ChunkInfo struct {
+			Rows int `json:"rows"`
+		} `json:"chunk_info"`
+	}
+	err = json.Unmarshal([]byte(apiResponses[0].Body), &chunkInfo)
+	if err != nil {
+		t.Fatalf("invalid response body: %v", err)
+	}
+
+	var laps []json.RawMessage
+	err = json.Unmarshal([]byte(*apiResponses[0].Chunks), &laps)
+	if err != nil {
+		t.Fatalf("invalid chunks: %v", err)
+	}
+	if len(laps) == 0 || len(laps) != chunkInfo.ChunkInfo.Rows {
+		t.Errorf("chunks have %d laps, want %d", len(laps), chunkInfo.ChunkInfo.Rows)
+	}
+}
+
+func TestHandlerPurgedSubsession(t *testing.T) {
+	server := fakeiracing.NewServer(nil)
+	defer server.Close()
+
+	memoryBus := bus.NewMemoryBus()
+	handler := newHandler(t, server, memoryBus)
+
+	err := handler.HandleApiRequest(context.Background(), &bus.ApiRequest{
+		Endpoint: "/data/results/get",
+		Params: map[string]string{
+			"subsession_id": "70000002",
+		},
+	})
+	if failure.Classify(err) != failure.ErrPermanent {
+		t.Errorf("HandleApiRequest() error = %v, want a permanent failure", err)
+	}
+
+	if apiResponses := responses(t, memoryBus); len(apiResponses) != 0 {
+		t.Errorf("published %d responses for a purged subsession, want none", len(apiResponses))
+	}
+}
+
+func TestHandlerLogsInAgain(t *testing.T) {
+	server := fakeiracing.NewServer(nil)
+	defer server.Close()
+
+	memoryBus := bus.NewMemoryBus()
+	handler := newHandler(t, server, memoryBus)
+
+	server.RevokeTokens()
+
+	err := handler.HandleApiRequest(context.Background(), &bus.ApiRequest{
+		Endpoint: "/data/results/get",
+		Params: map[string]string{
+			"subsession_id": "70000001",
+		},
+	})
+	if err != nil {
+		t.Fatalf("HandleApiRequest() error = %v", err)
+	}
+
+	// The call rejected with the revoked token, then the one after logging in again
+	if calls := server.Calls("/data/results/get"); calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+	if apiResponses := responses(t, memoryBus); len(apiResponses) != 1 {
+		t.Errorf("published %d responses, want 1", len(apiResponses))
+	}
+}
@@ -0,0 +1,372 @@
+package iracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/riccardotornesello/irapi-go"
+	"github.com/riccardotornesello/irapi-go/pkg/client"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ratelimit"
+)
+
+const (
+	// How long an account that fails is left out of the rotation
+	DefaultSidelineFor = 15 * time.Minute
+
+	// Consecutive failed calls that sideline an account, authentication failures sideline it at once
+	DefaultMaxFailures = 5
+
+	// Shortest time a rate-limited account is left out
+	minRateLimitPause = time.Second
+)
+
+// Credentials of an iRacing account.
+type Credentials struct {
+	// Name of the account in the logs and in the rate-limit buckets, the username by default
+	Name string `json:"name,omitempty"`
+
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+}
+
+// Login creates a client authenticated with the credentials, whose API calls
+// go through transport.
+func (c Credentials) Login(transport http.RoundTripper) (*irapi.IRacingApiClient, error) {
+	apiClient, err := irapi.NewIRacingPasswordLimitedApiClient(c.ClientID, c.ClientSecret, c.Username, c.Password)
+	if err != nil {
+		return nil, &AuthError{Err: err}
+	}
+
+	err = setHTTPClient(apiClient.Client, &http.Client{
+		Transport: transport,
+		Timeout:   apiCallTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return apiClient, nil
+}
+
+// setHTTPClient replaces the HTTP client of the API calls of an iRacing
+// client. irapi-go has no option for it, so its unexported field is set.
+func setHTTPClient(apiClient *client.ApiClient, httpClient *http.Client) error {
+	field := reflect.ValueOf(apiClient).Elem().FieldByName("client")
+	if !field.IsValid() || field.Type() != reflect.TypeFor[*http.Client]() {
+		return errors.New("unsupported iRacing client, cannot set its HTTP client")
+	}
+
+	reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Set(reflect.ValueOf(httpClient))
+	return nil
+}
+
+// ParseAccounts parses a JSON array of credentials, e.g.
+// [{"username": "a@example.com", "password": "..."}]. The accounts without a
+// client ID and secret use the ones of defaults. An empty string returns
+// defaults as the only account.
+func ParseAccounts(accounts string, defaults Credentials) ([]Credentials, error) {
+	if accounts == "" {
+		return []Credentials{withName(defaults)}, nil
+	}
+
+	var parsed []Credentials
+	err := json.Unmarshal([]byte(accounts), &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid iRacing accounts: %w", err)
+	}
+	if len(parsed) == 0 {
+		return nil, errors.New("invalid iRacing accounts: no account")
+	}
+
+	names := make(map[string]bool)
+	for i := range parsed {
+		if parsed[i].ClientID == "" && parsed[i].ClientSecret == "" {
+			parsed[i].ClientID = defaults.ClientID
+			parsed[i].ClientSecret = defaults.ClientSecret
+		}
+
+		parsed[i] = withName(parsed[i])
+		if names[parsed[i].Name] {
+			return nil, fmt.Errorf("invalid iRacing accounts: duplicate account '%s'", parsed[i].Name)
+		}
+		names[parsed[i].Name] = true
+	}
+
+	return parsed, nil
+}
+
+func withName(c Credentials) Credentials {
+	if c.Name == "" {
+		c.Name = c.Username
+	}
+
+	return c
+}
+
+// AccountBucket returns the name of the rate-limit bucket of an account.
+func AccountBucket(name string) string {
+	return RateLimitBucket + ":" + name
+}
+
+// Account is an iRacing account of a Pool, with its client and its health.
+type Account struct {
+	name    string
+	login   func() (*irapi.IRacingApiClient, error)
+	limiter *ratelimit.Limiter
+
+	// Serializes the logins of the account
+	loginMu sync.Mutex
+
+	mu               sync.Mutex
+	client           *irapi.IRacingApiClient
+	failures         int
+	sidelinedUntil   time.Time
+	rateLimitedUntil time.Time
+}
+
+func (a *Account) Name() string {
+	return a.name
+}
+
+// Client returns the authenticated client of the account, logging in when
+// there is none.
+func (a *Account) Client() (*irapi.IRacingApiClient, error) {
+	a.mu.Lock()
+	client := a.client
+	a.mu.Unlock()
+
+	if client != nil {
+		return client, nil
+	}
+
+	return a.Reauthenticate(nil)
+}
+
+// Reauthenticate replaces the client with a newly logged in one. Concurrent
+// calls rejected with the same client log in once: stale is the client that
+// was rejected, nil to log in anyway when there is no client.
+func (a *Account) Reauthenticate(stale *irapi.IRacingApiClient) (*irapi.IRacingApiClient, error) {
+	a.loginMu.Lock()
+	defer a.loginMu.Unlock()
+
+	a.mu.Lock()
+	current := a.client
+	a.mu.Unlock()
+
+	if current != nil && current != stale {
+		return current, nil
+	}
+
+	client, err := a.login()
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.client = client
+	return client, nil
+}
+
+// available reports whether the account can be used, or when it can be used again.
+func (a *Account) available(now time.Time) (bool, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	until := a.sidelinedUntil
+	if a.rateLimitedUntil.After(until) {
+		until = a.rateLimitedUntil
+	}
+
+	return !until.After(now), until
+}
+
+// Pool rotates the API calls across several iRacing accounts. Every account
+// has its own request budget, and an account that fails is sidelined for a
+// while instead of failing the requests.
+type Pool struct {
+	accounts []*Account
+
+	SidelineFor time.Duration
+	MaxFailures int
+
+	mu   sync.Mutex
+	next int
+}
+
+// NewPool creates a pool of the accounts. When db is not nil, every account
+// spends from its own request budget shared through MongoDB, kept in sync with
+// the rate-limit headers of its responses.
+func NewPool(accounts []Credentials, db *database.DB) *Pool {
+	p := &Pool{
+		SidelineFor: DefaultSidelineFor,
+		MaxFailures: DefaultMaxFailures,
+	}
+
+	for _, credentials := range accounts {
+		account := &Account{
+			name: credentials.Name,
+		}
+
+		// The rate-limit headers of the responses are reported to the budget of
+		// the account. The default transport is read at login, once redirected.
+		account.login = func() (*irapi.IRacingApiClient, error) {
+			return credentials.Login(&rateLimitTransport{
+				base:    http.DefaultTransport,
+				limiter: account.limiter,
+			})
+		}
+
+		if db != nil {
+			account.limiter = ratelimit.New(db, AccountBucket(credentials.Name))
+
+			// Move on to the next account rather than waiting for the budget to reset
+			if len(accounts) > 1 {
+				account.limiter.MaxWait = 0
+			}
+		}
+
+		p.accounts = append(p.accounts, account)
+	}
+
+	return p
+}
+
+// EnsureIndexes creates the indexes of the rate-limit buckets.
+func (p *Pool) EnsureIndexes(ctx context.Context) error {
+	for _, account := range p.accounts {
+		if account.limiter != nil {
+			return account.limiter.EnsureIndexes(ctx)
+		}
+	}
+
+	return nil
+}
+
+// Login logs in every account, sidelining the ones that fail. It only
+// returns an error when no account could log in.
+func (p *Pool) Login() error {
+	var errs []error
+
+	for _, account := range p.accounts {
+		_, err := account.Reauthenticate(nil)
+		if err != nil {
+			p.Failed(account, failure.Auth(fmt.Errorf("failed to log in: %w", err)))
+			errs = append(errs, fmt.Errorf("account '%s': %w", account.name, err))
+		}
+	}
+
+	if len(errs) == len(p.accounts) {
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
+
+// Acquire returns the next available account, logged in and with a request
+// taken from its budget. When no account is available it returns a
+// rate-limit failure until the first one is available again.
+func (p *Pool) Acquire(ctx context.Context) (*Account, error) {
+	p.mu.Lock()
+	start := p.next
+	p.mu.Unlock()
+
+	for i := range p.accounts {
+		account := p.accounts[(start+i)%len(p.accounts)]
+		if ok, _ := account.available(time.Now()); !ok {
+			continue
+		}
+
+		_, err := account.Client()
+		if err != nil {
+			p.Failed(account, failure.Auth(fmt.Errorf("failed to log in: %w", err)))
+			continue
+		}
+
+		err = account.limiter.Acquire(ctx)
+		if failure.Classify(err) == failure.ErrRateLimited {
+			p.Failed(account, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The next call starts from the following account
+		p.mu.Lock()
+		p.next = (start + i + 1) % len(p.accounts)
+		p.mu.Unlock()
+
+		return account, nil
+	}
+
+	return nil, failure.RateLimited(p.nextAvailable(), errors.New("no iRacing account is available"))
+}
+
+// nextAvailable returns when the first account is available again.
+func (p *Pool) nextAvailable() time.Time {
+	now := time.Now()
+
+	var next time.Time
+	for _, account := range p.accounts {
+		_, until := account.available(now)
+		if next.IsZero() || until.Before(next) {
+			next = until
+		}
+	}
+
+	return next
+}
+
+// Succeeded records a successful call of the account.
+func (p *Pool) Succeeded(account *Account) {
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	account.failures = 0
+}
+
+// Failed records a failed call of the account. Rate-limited accounts are left
+// out until the reset, accounts failing authentication or failing too many
+// calls in a row are sidelined. Permanent failures concern the request, not
+// the account, and are ignored.
+func (p *Pool) Failed(account *Account, err error) {
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	switch failure.Classify(err) {
+	case failure.ErrPermanent, failure.ErrDeferred:
+		return
+
+	case failure.ErrRateLimited:
+		account.rateLimitedUntil = time.Now().Add(max(failure.RetryAfter(err), minRateLimitPause))
+		return
+
+	case failure.ErrAuth:
+		// The client was rejected, the next use logs in again
+		account.client = nil
+		account.failures = p.MaxFailures
+
+	default:
+		account.failures++
+	}
+
+	if account.failures >= p.MaxFailures {
+		account.failures = 0
+		account.sidelinedUntil = time.Now().Add(p.SidelineFor)
+		log.Printf("Sidelining iRacing account '%s' until %s: %v", account.name, account.sidelinedUntil.Format(time.RFC3339), err)
+	}
+}
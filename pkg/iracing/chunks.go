@@ -0,0 +1,258 @@
+package iracing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/riccardotornesello/irapi-go/pkg/client"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/blob"
+)
+
+const (
+	DefaultChunkConcurrency = 4
+	DefaultChunkRetries     = 3
+
+	// First pause between two attempts of the same chunk
+	chunkRetryBackoff = time.Second
+
+	// Longest download of a single chunk file, a stalled one is retried
+	chunkDownloadTimeout = 60 * time.Second
+)
+
+// ChunkDownloader downloads the chunk files of a chunked response in
+// parallel. When it has a store, the chunks already downloaded are kept
+// there until the whole download succeeds, so a failed download resumes
+// where it stopped when the request is retried.
+type ChunkDownloader struct {
+	Concurrency int
+	Retries     int
+	Store       blob.Store
+
+	// Client downloads the chunk files. Without a client, the downloads use
+	// one with the default timeout.
+	Client *http.Client
+}
+
+func NewChunkDownloader(store blob.Store) *ChunkDownloader {
+	return &ChunkDownloader{
+		Concurrency: DefaultChunkConcurrency,
+		Retries:     DefaultChunkRetries,
+		Store:       store,
+		Client:      &http.Client{Timeout: chunkDownloadTimeout},
+	}
+}
+
+// Download returns the raw chunk files described by chunkInfo, in order,
+// checking their row counts against it. The key identifies the request the
+// chunks belong to. A nil ChunkDownloader uses the defaults without a store.
+func (d *ChunkDownloader) Download(ctx context.Context, key string, chunkInfo *client.IRacingChunkInfo) ([][]byte, error) {
+	if d == nil {
+		d = NewChunkDownloader(nil)
+	}
+
+	if len(chunkInfo.ChunkFileNames) != chunkInfo.NumChunks {
+		return nil, fmt.Errorf("expected %d chunk files, got %d", chunkInfo.NumChunks, len(chunkInfo.ChunkFileNames))
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	prefix := fmt.Sprintf("chunks/%s/", hex.EncodeToString(sum[:16]))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make([][]byte, len(chunkInfo.ChunkFileNames))
+	rows := make([]int, len(chunkInfo.ChunkFileNames))
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	semaphore := make(chan struct{}, max(d.Concurrency, 1))
+
+	for i := range chunkInfo.ChunkFileNames {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-semaphore }()
+
+			var err error
+			chunks[i], rows[i], err = d.chunk(ctx, prefix, i, chunkInfo)
+			if err != nil {
+				// Stop the other downloads, the chunks stored so far are kept
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	total := 0
+	for _, n := range rows {
+		total += n
+	}
+	if total != chunkInfo.Rows {
+		return nil, fmt.Errorf("expected %d rows in the chunks, got %d", chunkInfo.Rows, total)
+	}
+
+	// The download is complete, the stored chunks are not needed anymore
+	if d.Store != nil {
+		for i, chunkFileName := range chunkInfo.ChunkFileNames {
+			err := d.Store.Delete(context.WithoutCancel(ctx), chunkStoreKey(prefix, i, chunkFileName))
+			if err != nil {
+				log.Printf("Failed to delete stored chunk %d: %v", i, err)
+			}
+		}
+	}
+
+	return chunks, nil
+}
+
+func chunkStoreKey(prefix string, i int, chunkFileName string) string {
+	return fmt.Sprintf("%s%d-%s", prefix, i, chunkFileName)
+}
+
+// chunk returns a single chunk file and its row count, from the store when
+// it was downloaded before, retrying the download with backoff.
+func (d *ChunkDownloader) chunk(ctx context.Context, prefix string, i int, chunkInfo *client.IRacingChunkInfo) ([]byte, int, error) {
+	chunkFileName := chunkInfo.ChunkFileNames[i]
+	storeKey := chunkStoreKey(prefix, i, chunkFileName)
+
+	if d.Store != nil {
+		data, err := d.Store.Get(ctx, storeKey)
+		if err == nil {
+			// A stored chunk that does not check out is downloaded again
+			rows, err := countChunkRows(data, chunkInfo)
+			if err == nil {
+				return data, rows, nil
+			}
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		data, err := d.downloadChunk(ctx, chunkInfo.BaseDownloadUrl+chunkFileName)
+
+		var rows int
+		if err == nil {
+			rows, err = countChunkRows(data, chunkInfo)
+		}
+
+		if err == nil {
+			if d.Store != nil {
+				storeErr := d.Store.Put(ctx, storeKey, data)
+				if storeErr != nil {
+					log.Printf("Failed to store chunk %d: %v", i, storeErr)
+				}
+			}
+
+			return data, rows, nil
+		}
+
+		if attempt >= d.Retries || !retryableChunkError(err) {
+			return nil, 0, fmt.Errorf("failed to get chunk %d: %w", i, err)
+		}
+
+		select {
+		case <-time.After(chunkRetryBackoff << attempt):
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+}
+
+func (d *ChunkDownloader) downloadChunk(ctx context.Context, url string) ([]byte, error) {
+	httpClient := d.Client
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: chunkDownloadTimeout}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: res.StatusCode, Body: string(data)}
+	}
+
+	return data, nil
+}
+
+// countChunkRows checks that the chunk is a JSON array no larger than the
+// chunk size and returns its length.
+func countChunkRows(data []byte, chunkInfo *client.IRacingChunkInfo) (int, error) {
+	var rows []json.RawMessage
+	err := json.Unmarshal(data, &rows)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk: %w", err)
+	}
+
+	if chunkInfo.ChunkSize > 0 && len(rows) > chunkInfo.ChunkSize {
+		return 0, fmt.Errorf("chunk has %d rows, more than the chunk size of %d", len(rows), chunkInfo.ChunkSize)
+	}
+
+	return len(rows), nil
+}
+
+// retryableChunkError returns false for the client errors, which another
+// attempt at the same link cannot fix.
+func retryableChunkError(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	return !errors.Is(err, context.Canceled)
+}
+
+// MergeChunks concatenates the rows of the chunk files into a single JSON array.
+func MergeChunks(chunks [][]byte) ([]byte, error) {
+	rows := make([]json.RawMessage, 0)
+
+	for i, chunk := range chunks {
+		var chunkRows []json.RawMessage
+		err := json.Unmarshal(chunk, &chunkRows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal chunk %d: %w", i, err)
+		}
+
+		rows = append(rows, chunkRows...)
+	}
+
+	return json.Marshal(rows)
+}
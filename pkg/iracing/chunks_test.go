@@ -0,0 +1,198 @@
+package iracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/riccardotornesello/irapi-go/pkg/client"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/blob"
+)
+
+// chunkServer serves chunk files, counting the downloads of every file.
+type chunkServer struct {
+	*httptest.Server
+
+	files map[string]string
+
+	mu    sync.Mutex
+	calls map[string]int
+
+	// Called before serving a file, a non-zero status is returned instead
+	intercept func(name string) int
+}
+
+func newChunkServer(files map[string]string) *chunkServer {
+	s := &chunkServer{
+		files: files,
+		calls: make(map[string]int),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+
+		s.mu.Lock()
+		s.calls[name]++
+		intercept := s.intercept
+		s.mu.Unlock()
+
+		if intercept != nil {
+			if status := intercept(name); status != 0 {
+				http.Error(w, "intercepted", status)
+				return
+			}
+		}
+
+		data, ok := s.files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+
+	return s
+}
+
+func (s *chunkServer) Calls(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[name]
+}
+
+func (s *chunkServer) chunkInfo() *client.IRacingChunkInfo {
+	return &client.IRacingChunkInfo{
+		ChunkSize:       2,
+		NumChunks:       3,
+		Rows:            5,
+		BaseDownloadUrl: s.URL + "/",
+		ChunkFileNames:  []string{"a.json", "b.json", "c.json"},
+	}
+}
+
+var chunkFiles = map[string]string{
+	"a.json": `[{"lap": 1}, {"lap": 2}]`,
+	"b.json": `[{"lap": 3}, {"lap": 4}]`,
+	"c.json": `[{"lap": 5}]`,
+}
+
+func storedChunks(t *testing.T, store blob.Store) []string {
+	t.Helper()
+
+	keys, err := store.List(context.Background(), "chunks/")
+	if err != nil {
+		t.Fatalf("failed to list stored chunks: %v", err)
+	}
+
+	return keys
+}
+
+func TestChunkDownloaderResumes(t *testing.T) {
+	server := newChunkServer(chunkFiles)
+	defer server.Close()
+
+	store := blob.NewLocalStore(t.TempDir())
+	downloader := NewChunkDownloader(store)
+	downloader.Concurrency = 3
+
+	// The second chunk is not found until the others are stored
+	server.intercept = func(name string) int {
+		if name != "b.json" {
+			return 0
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(storedChunks(t, store)) < 2 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return http.StatusNotFound
+	}
+
+	key := "/data/results/lap_data?cust_id=100001&simsession_number=0&subsession_id=70000001"
+
+	_, err := downloader.Download(context.Background(), key, server.chunkInfo())
+	if err == nil {
+		t.Fatal("Download() with a missing chunk returned no error")
+	}
+	if stored := storedChunks(t, store); len(stored) != 2 {
+		t.Fatalf("stored chunks after the failed download = %v, want 2", stored)
+	}
+
+	server.mu.Lock()
+	server.intercept = nil
+	server.mu.Unlock()
+
+	chunks, err := downloader.Download(context.Background(), key, server.chunkInfo())
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+
+	merged, err := MergeChunks(chunks)
+	if err != nil {
+		t.Fatalf("MergeChunks() error = %v", err)
+	}
+	if want := `[{"lap":1},{"lap":2},{"lap":3},{"lap":4},{"lap":5}]`; string(merged) != want {
+		t.Errorf("merged chunks = %s, want %s", merged, want)
+	}
+
+	// Only the missing chunk was downloaded again
+	for name, want := range map[string]int{"a.json": 1, "b.json": 2, "c.json": 1} {
+		if got := server.Calls(name); got != want {
+			t.Errorf("downloads of %s = %d, want %d", name, got, want)
+		}
+	}
+
+	if stored := storedChunks(t, store); len(stored) != 0 {
+		t.Errorf("stored chunks after the download = %v, want none", stored)
+	}
+}
+
+func TestChunkDownloaderRefetchesInvalidStoredChunk(t *testing.T) {
+	server := newChunkServer(chunkFiles)
+	defer server.Close()
+
+	store := blob.NewLocalStore(t.TempDir())
+	downloader := NewChunkDownloader(store)
+
+	key := "/data/results/lap_data?cust_id=100002&simsession_number=0&subsession_id=70000001"
+
+	// The first download fails on the row count, leaving the chunks stored
+	chunkInfo := server.chunkInfo()
+	chunkInfo.Rows = 6
+
+	_, err := downloader.Download(context.Background(), key, chunkInfo)
+	if err == nil {
+		t.Fatal("Download() with a wrong row count returned no error")
+	}
+
+	stored := storedChunks(t, store)
+	if len(stored) != 3 {
+		t.Fatalf("stored chunks = %v, want 3", stored)
+	}
+
+	// Corrupt the first chunk in the store
+	for _, storeKey := range stored {
+		if strings.HasSuffix(storeKey, "a.json") {
+			err = store.Put(context.Background(), storeKey, []byte(`[{"lap": 1}`))
+			if err != nil {
+				t.Fatalf("failed to corrupt stored chunk: %v", err)
+			}
+		}
+	}
+
+	_, err = downloader.Download(context.Background(), key, server.chunkInfo())
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+
+	for name, want := range map[string]int{"a.json": 2, "b.json": 1, "c.json": 1} {
+		if got := server.Calls(name); got != want {
+			t.Errorf("downloads of %s = %d, want %d", name, got, want)
+		}
+	}
+}
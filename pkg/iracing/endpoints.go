@@ -0,0 +1,273 @@
+package iracing
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	carget "github.com/riccardotornesello/irapi-go/pkg/api/car/get"
+	carclassget "github.com/riccardotornesello/irapi-go/pkg/api/carclass/get"
+	leagueget "github.com/riccardotornesello/irapi-go/pkg/api/league/get"
+	"github.com/riccardotornesello/irapi-go/pkg/api/league/season_sessions"
+	"github.com/riccardotornesello/irapi-go/pkg/api/league/season_standings"
+	"github.com/riccardotornesello/irapi-go/pkg/api/league/seasons"
+	memberget "github.com/riccardotornesello/irapi-go/pkg/api/member/get"
+	"github.com/riccardotornesello/irapi-go/pkg/api/results/get"
+	"github.com/riccardotornesello/irapi-go/pkg/api/results/lap_data"
+	"github.com/riccardotornesello/irapi-go/pkg/api/track/assets"
+	trackget "github.com/riccardotornesello/irapi-go/pkg/api/track/get"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+// Types of the endpoint params
+const (
+	ParamInt     = "int"
+	ParamBool    = "bool"
+	ParamString  = "string"
+	ParamIntList = "int_list"
+)
+
+// Freshness of the endpoints missing from the registry
+const DefaultFreshness = time.Hour
+
+type Param struct {
+	Name     string
+	Type     string
+	Required bool
+}
+
+// Endpoint describes an iRacing API endpoint the scraper knows how to call.
+type Endpoint struct {
+	Path   string
+	Params []Param
+
+	// The payload is split in chunk files, downloaded and merged by the handler
+	Chunked bool
+
+	// Type the response body decodes into, and the one of the chunk rows
+	Response reflect.Type
+	Row      reflect.Type
+
+	// Fields of the response type filled by the client rather than sent by iRacing
+	Derived []string
+
+	// How long a fetched response can be reused
+	Freshness time.Duration
+}
+
+// Endpoints is the registry of the supported endpoints, by path.
+var Endpoints = map[string]*Endpoint{}
+
+func register(endpoint *Endpoint) {
+	Endpoints[endpoint.Path] = endpoint
+}
+
+func init() {
+	register(&Endpoint{
+		Path: "/data/results/get",
+		Params: []Param{
+			{Name: "subsession_id", Type: ParamInt, Required: true},
+			{Name: "include_licenses", Type: ParamBool},
+		},
+		Response:  reflect.TypeFor[get.ResultsGetResponse](),
+		Freshness: 24 * time.Hour,
+	})
+
+	register(&Endpoint{
+		Path: "/data/results/lap_data",
+		Params: []Param{
+			{Name: "subsession_id", Type: ParamInt, Required: true},
+			{Name: "simsession_number", Type: ParamInt, Required: true},
+			{Name: "cust_id", Type: ParamInt},
+			{Name: "team_id", Type: ParamInt},
+		},
+		Chunked:   true,
+		Response:  reflect.TypeFor[lap_data.ResultsLapDataResponse](),
+		Row:       reflect.TypeFor[lap_data.ResultsLapDataResponseChunk](),
+		Derived:   []string{"chunks"},
+		Freshness: 24 * time.Hour,
+	})
+
+	register(&Endpoint{
+		Path: "/data/league/season_sessions",
+		Params: []Param{
+			{Name: "league_id", Type: ParamInt, Required: true},
+			{Name: "season_id", Type: ParamInt, Required: true},
+			{Name: "results_only", Type: ParamBool},
+		},
+		Response:  reflect.TypeFor[season_sessions.LeagueSeasonSessionsResponse](),
+		Freshness: 10 * time.Minute,
+	})
+
+	register(&Endpoint{
+		Path: "/data/league/season_standings",
+		Params: []Param{
+			{Name: "league_id", Type: ParamInt, Required: true},
+			{Name: "season_id", Type: ParamInt, Required: true},
+			{Name: "car_class_id", Type: ParamInt},
+			{Name: "car_id", Type: ParamInt},
+		},
+		Response:  reflect.TypeFor[season_standings.LeagueSeasonStandingsResponse](),
+		Freshness: time.Hour,
+	})
+
+	register(&Endpoint{
+		Path: "/data/league/get",
+		Params: []Param{
+			{Name: "league_id", Type: ParamInt, Required: true},
+			{Name: "include_licenses", Type: ParamBool},
+		},
+		Response:  reflect.TypeFor[leagueget.LeagueGetResponse](),
+		Freshness: 24 * time.Hour,
+	})
+
+	register(&Endpoint{
+		Path: "/data/league/seasons",
+		Params: []Param{
+			{Name: "league_id", Type: ParamInt, Required: true},
+			{Name: "retired", Type: ParamBool},
+		},
+		Response:  reflect.TypeFor[seasons.LeagueSeasonsResponse](),
+		Freshness: time.Hour,
+	})
+
+	register(&Endpoint{
+		Path:      "/data/car/get",
+		Response:  reflect.TypeFor[carget.CarGetResponse](),
+		Freshness: 24 * time.Hour,
+	})
+
+	register(&Endpoint{
+		Path:      "/data/carclass/get",
+		Response:  reflect.TypeFor[carclassget.CarclassGetResponse](),
+		Freshness: 24 * time.Hour,
+	})
+
+	register(&Endpoint{
+		Path:      "/data/track/get",
+		Response:  reflect.TypeFor[trackget.TrackGetResponse](),
+		Freshness: 24 * time.Hour,
+	})
+
+	register(&Endpoint{
+		Path:      "/data/track/assets",
+		Response:  reflect.TypeFor[assets.TrackAssetsResponse](),
+		Freshness: 24 * time.Hour,
+	})
+
+	register(&Endpoint{
+		Path: "/data/member/get",
+		Params: []Param{
+			{Name: "cust_ids", Type: ParamIntList, Required: true},
+			{Name: "include_licenses", Type: ParamBool},
+		},
+		Response:  reflect.TypeFor[memberget.MemberGetResponse](),
+		Freshness: 24 * time.Hour,
+	})
+}
+
+// Lookup returns the registered endpoint with the given path.
+func Lookup(path string) (*Endpoint, bool) {
+	endpoint, ok := Endpoints[path]
+	return endpoint, ok
+}
+
+// Freshness returns how long a response of the endpoint can be reused.
+func Freshness(path string) time.Duration {
+	if endpoint, ok := Endpoints[path]; ok && endpoint.Freshness > 0 {
+		return endpoint.Freshness
+	}
+
+	return DefaultFreshness
+}
+
+// EndpointFreshness returns how long a response of the endpoint can be
+// reused, and false when the endpoint is not registered.
+func EndpointFreshness(path string) (time.Duration, bool) {
+	if _, ok := Endpoints[path]; !ok {
+		return 0, false
+	}
+
+	return Freshness(path), true
+}
+
+// Validate checks that the params are known, have the right type and that
+// the required ones are set.
+func (e *Endpoint) Validate(params map[string]string) error {
+	known := make(map[string]bool, len(e.Params))
+
+	for _, param := range e.Params {
+		known[param.Name] = true
+
+		value, ok := params[param.Name]
+		if !ok {
+			if param.Required {
+				return fmt.Errorf("missing required param '%s'", param.Name)
+			}
+			continue
+		}
+
+		err := validateParam(param.Type, value)
+		if err != nil {
+			return fmt.Errorf("invalid param '%s': %w", param.Name, err)
+		}
+	}
+
+	var unknown []string
+	for name := range params {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown params: %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+func validateParam(paramType string, value string) error {
+	switch paramType {
+	case ParamInt:
+		_, err := strconv.ParseInt(value, 10, 64)
+		return err
+
+	case ParamBool:
+		_, err := strconv.ParseBool(value)
+		return err
+
+	case ParamIntList:
+		for _, item := range strings.Split(value, ",") {
+			_, err := strconv.ParseInt(item, 10, 64)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return nil
+	}
+}
+
+// PrepareRequest validates the request against the registry and sets
+// whether its response is chunked. Invalid requests fail permanently.
+func PrepareRequest(msgData *bus.ApiRequest) (*Endpoint, error) {
+	endpoint, ok := Lookup(msgData.Endpoint)
+	if !ok {
+		return nil, failure.Permanent(fmt.Errorf("unsupported endpoint '%s'", msgData.Endpoint))
+	}
+
+	err := endpoint.Validate(msgData.Params)
+	if err != nil {
+		return nil, failure.Permanent(fmt.Errorf("invalid request to '%s': %w", msgData.Endpoint, err))
+	}
+
+	msgData.Chunks = endpoint.Chunked
+	return endpoint, nil
+}
@@ -0,0 +1,111 @@
+package iracing
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+func TestEndpointValidate(t *testing.T) {
+	endpoint := &Endpoint{
+		Path: "/data/test/get",
+		Params: []Param{
+			{Name: "subsession_id", Type: ParamInt, Required: true},
+			{Name: "include_licenses", Type: ParamBool},
+			{Name: "cust_ids", Type: ParamIntList},
+			{Name: "search", Type: ParamString},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		params  map[string]string
+		wantErr string
+	}{
+		{
+			name:   "required only",
+			params: map[string]string{"subsession_id": "70000001"},
+		},
+		{
+			name: "every param",
+			params: map[string]string{
+				"subsession_id":    "70000001",
+				"include_licenses": "true",
+				"cust_ids":         "100001,100002",
+				"search":           "anything",
+			},
+		},
+		{
+			name:    "missing required",
+			params:  map[string]string{"include_licenses": "true"},
+			wantErr: "missing required param 'subsession_id'",
+		},
+		{
+			name:    "invalid int",
+			params:  map[string]string{"subsession_id": "abc"},
+			wantErr: "invalid param 'subsession_id'",
+		},
+		{
+			name:    "invalid bool",
+			params:  map[string]string{"subsession_id": "1", "include_licenses": "maybe"},
+			wantErr: "invalid param 'include_licenses'",
+		},
+		{
+			name:    "invalid int list",
+			params:  map[string]string{"subsession_id": "1", "cust_ids": "100001,,100002"},
+			wantErr: "invalid param 'cust_ids'",
+		},
+		{
+			name:    "unknown params",
+			params:  map[string]string{"subsession_id": "1", "team_id": "2", "car_id": "3"},
+			wantErr: "unknown params: car_id, team_id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := endpoint.Validate(tt.params)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want none", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrepareRequest(t *testing.T) {
+	msgData := &bus.ApiRequest{
+		Endpoint: "/data/results/lap_data",
+		Params: map[string]string{
+			"subsession_id":     "70000001",
+			"simsession_number": "0",
+			"cust_id":           "100001",
+		},
+	}
+
+	_, err := PrepareRequest(msgData)
+	if err != nil {
+		t.Fatalf("PrepareRequest() error = %v", err)
+	}
+	if !msgData.Chunks {
+		t.Error("lap data request not marked as chunked")
+	}
+
+	for _, msgData := range []*bus.ApiRequest{
+		{Endpoint: "/data/unknown/get"},
+		{Endpoint: "/data/results/get", Params: map[string]string{"subsession_id": "latest"}},
+	} {
+		_, err := PrepareRequest(msgData)
+		if failure.Classify(err) != failure.ErrPermanent {
+			t.Errorf("PrepareRequest(%s) error = %v, want a permanent failure", msgData.Endpoint, err)
+		}
+	}
+}
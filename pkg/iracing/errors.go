@@ -0,0 +1,71 @@
+package iracing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+// Longest part of an error body kept in the error message
+const maxErrorBodyLength = 200
+
+// StatusError is a non-2xx response of the iRacing API or of a payload link.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	body := e.Body
+	if len(body) > maxErrorBodyLength {
+		body = body[:maxErrorBodyLength] + "..."
+	}
+
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, body)
+}
+
+// AuthError is a login or token renewal of an account that failed.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("failed to authenticate: %v", e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// apiStatusCode returns the status code of the response that made the call
+// fail, or zero when there was no response.
+func apiStatusCode(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+
+	return 0
+}
+
+// classifyApiError tags an error returned by the iRacing client with its failure category.
+func classifyApiError(err error) error {
+	statusCode := apiStatusCode(err)
+	err = fmt.Errorf("API call failed: %w", err)
+
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return failure.Auth(err)
+	}
+
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return failure.Auth(err)
+	case statusCode >= 400 && statusCode < 500 && statusCode != http.StatusTooManyRequests:
+		return failure.Permanent(err)
+	default:
+		return err
+	}
+}
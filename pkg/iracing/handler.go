@@ -6,36 +6,91 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
-	"cloud.google.com/go/pubsub/v2"
 	"github.com/riccardotornesello/irapi-go"
 	"github.com/riccardotornesello/irapi-go/pkg/client"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/archive"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/cache"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/drift"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ledger"
 )
 
-func HandleApiRequest(ctx context.Context, iracingClient *irapi.IRacingApiClient, pub *pubsub.Publisher, msgData *bus.ApiRequest) error {
+const (
+	// Attempts left to a request failing with a server error, and the first pause between them
+	maxServerRetries   = 3
+	serverRetryBackoff = 2 * time.Second
+)
+
+// Handler performs the API requests against iRacing and publishes their responses.
+type Handler struct {
+	Accounts   *Pool
+	Publisher  bus.Publisher
+	ClaimCheck *bus.ClaimCheck
+	Ledger     *ledger.Ledger
+	Archive    *archive.Archive
+	Chunks     *ChunkDownloader
+	Cache      *cache.Cache
+	Drift      *drift.Report
+}
+
+func (h *Handler) HandleApiRequest(ctx context.Context, msgData *bus.ApiRequest) error {
 	var err error
 	var chunksData *string
+	var chunkFiles [][]byte
 
-	// Generate the query parameters
-	paramsValues := url.Values{}
-	for k, v := range msgData.Params {
-		paramsValues.Add(k, fmt.Sprintf("%v", v))
-	}
+	// Requests published without an envelope start a new crawl
+	msgData.Envelope = msgData.Envelope.Ensure()
 
-	res, err := iracingClient.Client.Get(msgData.Endpoint, paramsValues.Encode())
+	// Refuse the requests that are not supported before any network call
+	endpoint, err := PrepareRequest(msgData)
 	if err != nil {
-		// TODO: handle error response properly
-		return fmt.Errorf("API call failed: %v", err)
+		return err
 	}
-	defer res.Body.Close()
 
-	log.Printf("API call to '%s' succeeded with status: %s", msgData.Endpoint, res.Status)
+	// Defer the requests scheduled for later
+	if !msgData.Due() {
+		return failure.Deferred(*msgData.NotBefore, fmt.Errorf("request to '%s' is not due yet", msgData.Endpoint))
+	}
 
-	bodyBytes, err := io.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response body: %v", err)
+	// Skip the requests whose response was fetched recently, unless a refresh is forced
+	if !msgData.ForceRefresh {
+		fresh, err := h.Ledger.Fresh(ctx, msgData.Endpoint, msgData.Params, msgData.NotBefore)
+		if err != nil {
+			return fmt.Errorf("failed to check request ledger: %w", err)
+		}
+		if fresh {
+			log.Printf("[%s] Skipping API call to '%s', response is still fresh", msgData.Envelope, msgData.Endpoint)
+			return nil
+		}
+	}
+
+	// Skip the requests that can never succeed, unless a refresh is forced
+	if !msgData.ForceRefresh {
+		failed, err := h.Ledger.Failed(ctx, msgData.Endpoint, msgData.Params)
+		if err != nil {
+			return fmt.Errorf("failed to check request ledger: %w", err)
+		}
+		if failed {
+			log.Printf("[%s] Skipping API call to '%s', request failed permanently", msgData.Envelope, msgData.Endpoint)
+			return nil
+		}
+	}
+
+	// Serve the slow-changing endpoints from the cache
+	bodyBytes, cached := h.cached(ctx, msgData)
+	if cached {
+		log.Printf("[%s] Serving '%s' from the response cache", msgData.Envelope, msgData.Endpoint)
+	} else {
+		bodyBytes, err = h.call(ctx, msgData)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Parse chunks if requested
@@ -44,47 +99,94 @@ func HandleApiRequest(ctx context.Context, iracingClient *irapi.IRacingApiClient
 		var bodyMap map[string]json.RawMessage
 		err = json.Unmarshal(bodyBytes, &bodyMap)
 		if err != nil {
-			return fmt.Errorf("failed to unmarshal response body for chunk info: %v", err)
+			return failure.Permanent(fmt.Errorf("failed to unmarshal response body for chunk info: %w", err))
 		}
 
 		var chunkInfo client.IRacingChunkInfo
 		err = json.Unmarshal(bodyMap["chunk_info"], &chunkInfo)
 		if err != nil {
-			return fmt.Errorf("failed to unmarshal chunk_info: %v", err)
+			return failure.Permanent(fmt.Errorf("failed to unmarshal chunk_info: %w", err))
 		}
 
 		// Fetch all chunks
-		fullData, err := client.GetChunks[map[string]interface{}](&chunkInfo)
+		chunkFiles, err = h.Chunks.Download(ctx, ledger.Key(msgData.Endpoint, msgData.Params), &chunkInfo)
 		if err != nil {
-			return fmt.Errorf("failed to get chunks: %v", err)
+			return fmt.Errorf("failed to get chunks: %w", err)
 		}
 
-		log.Printf("Successfully retrieved %d chunks for endpoint '%s'", chunkInfo.NumChunks, msgData.Endpoint)
+		log.Printf("[%s] Successfully retrieved %d chunks for endpoint '%s'", msgData.Envelope, chunkInfo.NumChunks, msgData.Endpoint)
 
-		// Marshal full data back to JSON
-		fullDataBytes, err := json.Marshal(fullData)
+		// Merge the rows of the chunks in a single JSON array
+		fullDataBytes, err := MergeChunks(chunkFiles)
 		if err != nil {
-			return fmt.Errorf("failed to marshal full chunked data: %v", err)
+			return failure.Permanent(fmt.Errorf("failed to merge chunked data: %w", err))
 		}
 
 		chunksStr := string(fullDataBytes)
 		chunksData = &chunksStr
 	}
 
+	// Refuse the payloads that do not decode into the response types
+	var chunksBytes []byte
+	if chunksData != nil {
+		chunksBytes = []byte(*chunksData)
+	}
+
+	changes, err := endpoint.ValidateResponse(bodyBytes, chunksBytes)
+	if err != nil {
+		return err
+	}
+
+	if !changes.Empty() {
+		log.Printf("[%s] Response of '%s' drifted from its schema, unknown fields: %v, missing fields: %v, mismatched fields: %v", msgData.Envelope, msgData.Endpoint, changes.Unknown, changes.Missing, changes.Mismatched)
+
+		err = h.Drift.Record(ctx, msgData.Endpoint, msgData.MessageID, changes)
+		if err != nil {
+			log.Printf("[%s] Failed to record schema drift: %v", msgData.Envelope, err)
+		}
+	}
+
+	// Cache the validated body of the slow-changing endpoints
+	if !cached && !msgData.Chunks {
+		err = h.Cache.Put(ctx, msgData.Endpoint, msgData.Params, bodyBytes)
+		if err != nil {
+			log.Printf("[%s] Failed to write response cache: %v", msgData.Envelope, err)
+		}
+	}
+
+	// Keep the raw payloads for audits, the cached ones were archived when fetched
+	if !cached {
+		err = h.archiveResponse(ctx, msgData, bodyBytes, chunkFiles)
+		if err != nil {
+			// Not worth calling iRacing again, the response is still published
+			log.Printf("[%s] Failed to archive API response: %v", msgData.Envelope, err)
+		}
+	}
+
 	// Publish the response body to the response topic
 	apiResponse := bus.ApiResponse{
+		Envelope: msgData.Envelope,
 		Endpoint: msgData.Endpoint,
 		Params:   msgData.Params,
 		Body:     string(bodyBytes),
 		Chunks:   chunksData,
+
+		NotBefore:    msgData.NotBefore,
+		ForceRefresh: msgData.ForceRefresh,
+	}
+
+	// Move oversized payloads out of the message
+	err = h.ClaimCheck.Offload(ctx, &apiResponse)
+	if err != nil {
+		return fmt.Errorf("failed to offload API response: %w", err)
 	}
 
 	data, err := json.Marshal(apiResponse)
 	if err != nil {
-		return fmt.Errorf("failed to marshal API response: %v", err)
+		return failure.Permanent(fmt.Errorf("failed to marshal API response: %w", err))
 	}
 
-	result := pub.Publish(ctx, &pubsub.Message{
+	result := h.Publisher.Publish(ctx, &bus.Message{
 		Data: data,
 		Attributes: map[string]string{
 			"endpoint": msgData.Endpoint,
@@ -92,8 +194,180 @@ func HandleApiRequest(ctx context.Context, iracingClient *irapi.IRacingApiClient
 	})
 	_, err = result.Get(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to publish response message: %v", err)
+		return fmt.Errorf("failed to publish response message: %w", err)
+	}
+
+	// Record the fetch so identical requests can be skipped
+	err = h.Ledger.MarkFetched(ctx, msgData.Endpoint, msgData.Params)
+	if err != nil {
+		log.Printf("[%s] Failed to record fetched request: %v", msgData.Envelope, err)
 	}
 
 	return nil
 }
+
+// cached returns the cached body of the request. Chunked responses are never
+// cached, as their chunk links expire.
+func (h *Handler) cached(ctx context.Context, msgData *bus.ApiRequest) ([]byte, bool) {
+	if msgData.ForceRefresh || msgData.Chunks {
+		return nil, false
+	}
+
+	body, ok, err := h.Cache.Get(ctx, msgData.Endpoint, msgData.Params)
+	if err != nil {
+		log.Printf("[%s] Failed to read response cache: %v", msgData.Envelope, err)
+		return nil, false
+	}
+
+	return body, ok
+}
+
+// call performs the API call with the next available account, within its
+// request budget. A call rejected because of the account is tried again with
+// the next one.
+func (h *Handler) call(ctx context.Context, msgData *bus.ApiRequest) ([]byte, error) {
+	// Generate the query parameters
+	paramsValues := url.Values{}
+	for k, v := range msgData.Params {
+		paramsValues.Add(k, fmt.Sprintf("%v", v))
+	}
+
+	var err error
+	for range h.Accounts.accounts {
+		var account *Account
+		account, err = h.Accounts.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var bodyBytes []byte
+		bodyBytes, err = h.fetch(ctx, account, msgData, paramsValues.Encode())
+		if err == nil {
+			h.Accounts.Succeeded(account)
+			log.Printf("[%s] API call to '%s' succeeded", msgData.Envelope, msgData.Endpoint)
+
+			return bodyBytes, nil
+		}
+
+		// The resource does not exist, e.g. a purged subsession
+		if apiStatusCode(err) == http.StatusNotFound {
+			markErr := h.Ledger.MarkFailed(ctx, msgData.Endpoint, msgData.Params, err)
+			if markErr != nil {
+				log.Printf("[%s] Failed to record failed request: %v", msgData.Envelope, markErr)
+			}
+		}
+
+		err = classifyApiError(err)
+		h.Accounts.Failed(account, err)
+
+		class := failure.Classify(err)
+		if class != failure.ErrAuth && class != failure.ErrRateLimited {
+			return nil, err
+		}
+
+		log.Printf("[%s] API call to '%s' was rejected for account '%s', trying the next account: %v", msgData.Envelope, msgData.Endpoint, account.Name(), err)
+	}
+
+	return nil, err
+}
+
+// fetch performs the API call with account and returns the body of the
+// payload. It logs in again once when the token is rejected, and retries
+// server errors with backoff. Error responses are returned as errors, never
+// as a body.
+func (h *Handler) fetch(ctx context.Context, account *Account, msgData *bus.ApiRequest, params string) ([]byte, error) {
+	client, err := account.Client()
+	if err != nil {
+		return nil, failure.Auth(fmt.Errorf("failed to log in: %w", err))
+	}
+
+	reauthenticated := false
+
+	for attempt := 0; ; attempt++ {
+		body, err := getPayload(client, msgData.Endpoint, params)
+		if err == nil {
+			return body, nil
+		}
+
+		statusCode := apiStatusCode(err)
+		switch {
+		case statusCode == http.StatusUnauthorized && !reauthenticated:
+			log.Printf("[%s] API call to '%s' was not authorized for account '%s', logging in again", msgData.Envelope, msgData.Endpoint, account.Name())
+
+			client, err = account.Reauthenticate(client)
+			if err != nil {
+				return nil, failure.Auth(fmt.Errorf("failed to log in again: %w", err))
+			}
+			reauthenticated = true
+
+		case statusCode >= 500 && attempt < maxServerRetries:
+			wait := serverRetryBackoff << attempt
+			log.Printf("[%s] API call to '%s' failed with status %d, retrying in %s", msgData.Envelope, msgData.Endpoint, statusCode, wait)
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+
+		default:
+			return nil, err
+		}
+	}
+}
+
+// getPayload performs a single API call and downloads its payload.
+func getPayload(client *irapi.IRacingApiClient, endpoint string, params string) ([]byte, error) {
+	res, err := client.Client.Get(endpoint, params)
+	if err != nil {
+		// irapi-go only reports the failed token renewals as text
+		if strings.HasPrefix(err.Error(), "error ensuring valid token") {
+			return nil, &AuthError{Err: err}
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, &StatusError{StatusCode: res.StatusCode, Body: string(body)}
+	}
+
+	return body, nil
+}
+
+// archiveResponse stores the raw body and chunk files of a response and
+// records the call in the archive index.
+func (h *Handler) archiveResponse(ctx context.Context, msgData *bus.ApiRequest, body []byte, chunkFiles [][]byte) error {
+	if h.Archive == nil {
+		return nil
+	}
+
+	record := archive.Record{
+		Endpoint:  msgData.Endpoint,
+		Params:    msgData.Params,
+		FetchedAt: time.Now().UTC(),
+		MessageID: msgData.MessageID,
+		RootID:    msgData.RootID,
+	}
+
+	digest, err := h.Archive.Put(ctx, body)
+	if err != nil {
+		return err
+	}
+	record.Body = digest
+
+	for _, chunkFile := range chunkFiles {
+		digest, err := h.Archive.Put(ctx, chunkFile)
+		if err != nil {
+			return err
+		}
+		record.Chunks = append(record.Chunks, digest)
+	}
+
+	return h.Archive.Record(ctx, &record)
+}
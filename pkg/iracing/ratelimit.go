@@ -0,0 +1,77 @@
+package iracing
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ratelimit"
+)
+
+const (
+	// Host of the iRacing API, the only one whose responses carry the rate-limit headers
+	apiHost = "members-ng.iracing.com"
+
+	// Name of the shared rate-limit bucket of the iRacing account
+	RateLimitBucket = "iracing"
+
+	// Longest time of an iRacing API call, as set by the iRacing client
+	apiCallTimeout = 60 * time.Second
+)
+
+// rateLimitTransport reports the rate-limit headers of the iRacing API
+// responses of an account to its limiter, which can be nil. A 429 response
+// becomes a rate-limit failure, so the request is deferred until the reset
+// instead of holding up the iRacing client, and the other error responses
+// become a *StatusError, which the iRacing client wraps.
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	limiter *ratelimit.Limiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil || req.URL.Host != apiHost {
+		return res, err
+	}
+
+	limit, limitErr := strconv.Atoi(res.Header.Get("X-RateLimit-Limit"))
+	remaining, remainingErr := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining"))
+	reset, resetErr := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+
+	if limitErr == nil && remainingErr == nil && resetErr == nil {
+		observeErr := t.limiter.Observe(req.Context(), limit, remaining, time.Unix(reset, 0))
+		if observeErr != nil {
+			log.Printf("Failed to record iRacing rate limit: %v", observeErr)
+		}
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		res.Body.Close()
+
+		// Same default as the iRacing client when the reset is unknown
+		resetAt := time.Now().Add(5 * time.Second)
+		if resetErr == nil && reset > 0 {
+			resetAt = time.Unix(reset, 0)
+		}
+
+		return nil, failure.RateLimited(resetAt, fmt.Errorf("iRacing responded with status %d", res.StatusCode))
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+
+		body, readErr := io.ReadAll(res.Body)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", readErr)
+		}
+
+		return nil, &StatusError{StatusCode: res.StatusCode, Body: string(body)}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,52 @@
+package iracing
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Host of the iRacing authentication API
+const authHost = "oauth.iracing.com"
+
+type redirectTransport struct {
+	base   http.RoundTripper
+	target *url.URL
+}
+
+// RedirectAPI sends the calls to the iRacing authentication and data APIs to
+// baseURL instead, e.g. a fake iRacing server. The iRacing client logs in and
+// downloads the payloads with the default client, so the default transport is
+// wrapped. It must be called before logging in, as the transport of the API
+// calls of every account wraps it.
+func RedirectAPI(baseURL string) error {
+	target, err := url.Parse(baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid iRacing API URL: %w", err)
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return fmt.Errorf("invalid iRacing API URL: %s", baseURL)
+	}
+
+	http.DefaultTransport = &redirectTransport{
+		base:   http.DefaultTransport,
+		target: target,
+	}
+
+	return nil
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != apiHost && req.URL.Host != authHost {
+		return t.base.RoundTrip(req)
+	}
+
+	redirected := req.Clone(req.Context())
+	redirected.URL.Scheme = t.target.Scheme
+	redirected.URL.Host = t.target.Host
+	redirected.URL.Path = strings.TrimSuffix(t.target.Path, "/") + req.URL.Path
+	redirected.Host = ""
+
+	return t.base.RoundTrip(redirected)
+}
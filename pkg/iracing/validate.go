@@ -0,0 +1,74 @@
+package iracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/drift"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+// ValidateResponse checks the body, and the merged chunk rows of the chunked
+// endpoints, against the response types of the endpoint. Malformed and
+// truncated payloads, and payloads of the wrong kind, fail permanently. The
+// fields in which the payloads differ from the types, including the values
+// the types cannot decode, are returned as schema drift, with the paths of
+// the chunk rows prefixed by "chunks[]".
+func (e *Endpoint) ValidateResponse(body []byte, chunks []byte) (*drift.Changes, error) {
+	changes := &drift.Changes{}
+
+	if e.Response != nil {
+		bodyChanges, err := validatePayload(body, e.Response)
+		if err != nil {
+			return nil, failure.Permanent(fmt.Errorf("invalid response body of '%s': %w", e.Path, err))
+		}
+
+		changes = bodyChanges.Without(e.Derived...)
+	}
+
+	if e.Row != nil && chunks != nil {
+		rowChanges, err := validatePayload(chunks, reflect.SliceOf(e.Row))
+		if err != nil {
+			return nil, failure.Permanent(fmt.Errorf("invalid chunks of '%s': %w", e.Path, err))
+		}
+
+		for _, field := range rowChanges.Unknown {
+			changes.Unknown = append(changes.Unknown, "chunks"+field)
+		}
+		for _, field := range rowChanges.Missing {
+			changes.Missing = append(changes.Missing, "chunks"+field)
+		}
+		for _, field := range rowChanges.Mismatched {
+			changes.Mismatched = append(changes.Mismatched, "chunks"+field)
+		}
+	}
+
+	return changes, nil
+}
+
+// validatePayload checks that the JSON payload is complete and of the kind of
+// t, and compares their fields. A field iRacing changed the type of is only
+// drift, it is up to the processors to decode it or not.
+func validatePayload(data []byte, t reflect.Type) (*drift.Changes, error) {
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("malformed or truncated JSON of %d bytes", len(data))
+	}
+
+	// A null or a value of another kind would decode without errors
+	trimmed := bytes.TrimSpace(data)
+	if t.Kind() == reflect.Struct && trimmed[0] != '{' || t.Kind() == reflect.Slice && trimmed[0] != '[' {
+		return nil, fmt.Errorf("expected a JSON %s, got %.20s", jsonKind(t), trimmed)
+	}
+
+	return drift.Compare(data, t)
+}
+
+func jsonKind(t reflect.Type) string {
+	if t.Kind() == reflect.Slice {
+		return "array"
+	}
+
+	return "object"
+}
@@ -0,0 +1,363 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+)
+
+const (
+	// How long a fetched response is considered fresh when the endpoint has no specific freshness
+	DefaultFreshness = time.Hour
+
+	// How long a published request is considered in flight
+	DefaultPendingTimeout = time.Hour
+
+	// How long a request that failed permanently is not attempted again
+	FailedRetention = 30 * 24 * time.Hour
+)
+
+// Ledger records the API requests in flight and the responses already
+// fetched, so that identical requests are not repeated.
+type Ledger struct {
+	db             *database.DB
+	PendingTimeout time.Duration
+
+	// Freshness returns how long the responses of an endpoint can be reused
+	Freshness func(endpoint string) time.Duration
+}
+
+func New(db *database.DB, freshness func(endpoint string) time.Duration) *Ledger {
+	return &Ledger{
+		db:             db,
+		PendingTimeout: DefaultPendingTimeout,
+		Freshness:      freshness,
+	}
+}
+
+// Key identifies a request by its endpoint and canonicalized params.
+func Key(endpoint string, params map[string]string) string {
+	values := url.Values{}
+	for k, v := range params {
+		values.Set(k, v)
+	}
+
+	// Encode sorts the params by key
+	return endpoint + "?" + values.Encode()
+}
+
+func (l *Ledger) freshness(endpoint string) time.Duration {
+	if l.Freshness == nil {
+		return DefaultFreshness
+	}
+
+	return l.Freshness(endpoint)
+}
+
+func (l *Ledger) collection() *mongo.Collection {
+	return l.db.DB.Collection(Collection)
+}
+
+// EnsureIndexes creates the indexes used to look up and expire entries.
+func (l *Ledger) EnsureIndexes(ctx context.Context) error {
+	_, err := l.collection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "meta.kind", Value: 1}, {Key: "meta.name", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "status.expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys: bson.D{{Key: "status.state", Value: 1}, {Key: "status.not_before", Value: 1}},
+		},
+	})
+	return err
+}
+
+// Reserve marks the request as in flight and returns true, or returns false
+// when an identical request is already in flight, its response is fresh or
+// it failed permanently.
+// A request with notBefore is deferred: it ignores the responses fetched so
+// far and only yields to another deferred request still waiting.
+// A nil Ledger reserves everything.
+func (l *Ledger) Reserve(ctx context.Context, endpoint string, params map[string]string, notBefore *time.Time) (bool, error) {
+	if l == nil {
+		return true, nil
+	}
+
+	now := time.Now().UTC()
+
+	// Only entries that are stale can be taken over, otherwise the upsert
+	// collides with the existing entry on the unique index
+	stale := bson.A{
+		bson.M{"status.state": StatePending, "status.expires_at": bson.M{"$lt": now}},
+		bson.M{"status.state": StateFetched, "status.fetched_at": bson.M{"$lt": now.Add(-l.freshness(endpoint))}},
+		bson.M{"status.state": bson.M{"$nin": bson.A{StatePending, StateFetched, StateFailed}}},
+	}
+	set := bson.M{
+		"status.state":        StatePending,
+		"status.requested_at": now,
+		"status.expires_at":   now.Add(l.PendingTimeout),
+	}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"meta.version":    0,
+			"meta.created_at": now,
+			"meta.labels":     bson.M{"endpoint": endpoint},
+		},
+		"$set": set,
+	}
+
+	if notBefore != nil {
+		stale = bson.A{
+			bson.M{"status.state": bson.M{"$nin": bson.A{StatePending, StateFailed}}},
+			bson.M{"status.expires_at": bson.M{"$lt": now}},
+			bson.M{"status.not_before": bson.M{"$not": bson.M{"$gt": now}}},
+		}
+		set["status.not_before"] = notBefore.UTC()
+		set["status.expires_at"] = notBefore.UTC().Add(l.PendingTimeout)
+		update["$unset"] = bson.M{"spec.message": ""}
+	} else {
+		update["$unset"] = bson.M{"status.not_before": "", "spec.message": ""}
+	}
+
+	filter := bson.M{
+		"meta.kind": Kind,
+		"meta.name": Key(endpoint, params),
+		"$or":       stale,
+	}
+
+	_, err := l.collection().UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Release drops the reservation of a request that could not be published.
+func (l *Ledger) Release(ctx context.Context, endpoint string, params map[string]string) error {
+	if l == nil {
+		return nil
+	}
+
+	_, err := l.collection().DeleteOne(ctx, bson.M{
+		"meta.kind":    Kind,
+		"meta.name":    Key(endpoint, params),
+		"status.state": StatePending,
+	})
+	return err
+}
+
+// Fresh returns true when the response of the request was fetched recently,
+// and not before notBefore when set.
+func (l *Ledger) Fresh(ctx context.Context, endpoint string, params map[string]string, notBefore *time.Time) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+
+	since := time.Now().UTC().Add(-l.freshness(endpoint))
+	if notBefore != nil && notBefore.After(since) {
+		since = notBefore.UTC()
+	}
+
+	filter := bson.M{
+		"meta.kind":         Kind,
+		"meta.name":         Key(endpoint, params),
+		"status.state":      StateFetched,
+		"status.fetched_at": bson.M{"$gte": since},
+	}
+
+	err := l.collection().FindOne(ctx, filter).Err()
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// MarkFetched records that the response of the request was just fetched.
+func (l *Ledger) MarkFetched(ctx context.Context, endpoint string, params map[string]string) error {
+	if l == nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+
+	filter := bson.M{"meta.kind": Kind, "meta.name": Key(endpoint, params)}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"meta.version":    0,
+			"meta.created_at": now,
+			"meta.labels":     bson.M{"endpoint": endpoint},
+		},
+		"$set": bson.M{
+			"status.state":      StateFetched,
+			"status.fetched_at": now,
+			"status.expires_at": now.Add(l.freshness(endpoint)),
+		},
+		"$unset": bson.M{"status.not_before": "", "spec.message": ""},
+	}
+
+	_, err := l.collection().UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+	return err
+}
+
+// Failed returns true when the request failed permanently and must not be attempted again.
+func (l *Ledger) Failed(ctx context.Context, endpoint string, params map[string]string) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+
+	filter := bson.M{
+		"meta.kind":    Kind,
+		"meta.name":    Key(endpoint, params),
+		"status.state": StateFailed,
+	}
+
+	err := l.collection().FindOne(ctx, filter).Err()
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// MarkFailed records that the request failed permanently, e.g. because the
+// resource does not exist anymore, so it is not attempted again for FailedRetention.
+func (l *Ledger) MarkFailed(ctx context.Context, endpoint string, params map[string]string, cause error) error {
+	if l == nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+
+	filter := bson.M{"meta.kind": Kind, "meta.name": Key(endpoint, params)}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"meta.version":    0,
+			"meta.created_at": now,
+			"meta.labels":     bson.M{"endpoint": endpoint},
+		},
+		"$set": bson.M{
+			"status.state":      StateFailed,
+			"status.failed_at":  now,
+			"status.error":      cause.Error(),
+			"status.expires_at": now.Add(FailedRetention),
+		},
+		"$unset": bson.M{"status.not_before": "", "spec.message": ""},
+	}
+
+	_, err := l.collection().UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+	return err
+}
+
+// Park keeps a deferred request message in the ledger until notBefore, so
+// that the queue does not have to hold it. The message is handed back by
+// NextDue once due.
+func (l *Ledger) Park(ctx context.Context, endpoint string, params map[string]string, notBefore time.Time, data []byte, attributes map[string]string) error {
+	if l == nil {
+		return errors.New("no request ledger to park the request in")
+	}
+
+	now := time.Now().UTC()
+
+	filter := bson.M{"meta.kind": Kind, "meta.name": Key(endpoint, params)}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"meta.version":    0,
+			"meta.created_at": now,
+			"meta.labels":     bson.M{"endpoint": endpoint},
+		},
+		"$set": bson.M{
+			"spec.message": ParkedMessage{
+				Data:       data,
+				Attributes: attributes,
+			},
+			"status.state":        StatePending,
+			"status.requested_at": now,
+			"status.not_before":   notBefore.UTC(),
+			"status.expires_at":   notBefore.UTC().Add(l.PendingTimeout),
+		},
+	}
+
+	_, err := l.collection().UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+	return err
+}
+
+// NextDue claims a parked request message that is due and returns it, or
+// returns nil when there is none. The entry stays pending while the message
+// is published again.
+func (l *Ledger) NextDue(ctx context.Context) (*ParkedMessage, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	now := time.Now().UTC()
+
+	filter := bson.M{
+		"meta.kind":         Kind,
+		"status.state":      StatePending,
+		"status.not_before": bson.M{"$lte": now},
+		"spec.message":      bson.M{"$exists": true},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status.requested_at": now,
+			"status.expires_at":   now.Add(l.PendingTimeout),
+		},
+		"$unset": bson.M{"spec.message": ""},
+	}
+
+	var doc RequestDoc
+	err := l.collection().FindOneAndUpdate(ctx, filter, update).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if doc.Spec.Message == nil {
+		return nil, nil
+	}
+
+	doc.Spec.Message.Name = doc.Meta.Name
+	return doc.Spec.Message, nil
+}
+
+// Unclaim parks again a message claimed with NextDue that could not be published.
+func (l *Ledger) Unclaim(ctx context.Context, message *ParkedMessage) error {
+	if l == nil {
+		return nil
+	}
+
+	filter := bson.M{
+		"meta.kind":    Kind,
+		"meta.name":    message.Name,
+		"status.state": StatePending,
+	}
+	update := bson.M{
+		"$set": bson.M{"spec.message": message},
+	}
+
+	_, err := l.collection().UpdateOne(ctx, filter, update)
+	return err
+}
@@ -0,0 +1,54 @@
+package ledger
+
+import "testing"
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		params   map[string]string
+		want     string
+	}{
+		{
+			name:     "no params",
+			endpoint: "/data/car/get",
+			want:     "/data/car/get?",
+		},
+		{
+			name:     "params sorted by key",
+			endpoint: "/data/results/lap_data",
+			params: map[string]string{
+				"subsession_id":     "70000001",
+				"simsession_number": "0",
+				"cust_id":           "100001",
+			},
+			want: "/data/results/lap_data?cust_id=100001&simsession_number=0&subsession_id=70000001",
+		},
+		{
+			name:     "values escaped",
+			endpoint: "/data/member/get",
+			params: map[string]string{
+				"cust_ids": "100001,100002",
+			},
+			want: "/data/member/get?cust_ids=100001%2C100002",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Key(tt.endpoint, tt.params)
+			if got != tt.want {
+				t.Errorf("Key() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyIgnoresParamOrder(t *testing.T) {
+	first := Key("/data/league/season_sessions", map[string]string{"league_id": "4403", "season_id": "111025"})
+	second := Key("/data/league/season_sessions", map[string]string{"season_id": "111025", "league_id": "4403"})
+
+	if first != second {
+		t.Errorf("keys differ: %q and %q", first, second)
+	}
+}
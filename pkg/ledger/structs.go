@@ -0,0 +1,50 @@
+package ledger
+
+import (
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+)
+
+const (
+	Collection = "requests"
+	Kind       = "api_request"
+
+	StatePending = "pending"
+	StateFetched = "fetched"
+	StateFailed  = "failed"
+)
+
+type RequestDoc struct {
+	Meta   database.Meta `bson:"meta,omitempty"`
+	Spec   RequestSpec   `bson:"spec,omitempty"`
+	Status RequestStatus `bson:"status,omitempty"`
+}
+
+type RequestSpec struct {
+	// Set while a deferred request waits in the ledger instead of the queue
+	Message *ParkedMessage `bson:"message,omitempty"`
+}
+
+// ParkedMessage is a deferred request message waiting to be published again.
+type ParkedMessage struct {
+	// Name of the ledger entry, not stored in the message
+	Name string `bson:"-"`
+
+	Data       []byte            `bson:"data"`
+	Attributes map[string]string `bson:"attributes,omitempty"`
+}
+
+type RequestStatus struct {
+	State       string     `bson:"state"`
+	RequestedAt *time.Time `bson:"requested_at,omitempty"`
+	FetchedAt   *time.Time `bson:"fetched_at,omitempty"`
+	FailedAt    *time.Time `bson:"failed_at,omitempty"`
+	Error       string     `bson:"error,omitempty"`
+
+	// Set while a deferred request is pending
+	NotBefore *time.Time `bson:"not_before,omitempty"`
+
+	// The entry is removed by MongoDB once expired
+	ExpiresAt time.Time `bson:"expires_at"`
+}
@@ -0,0 +1,199 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/riccardotornesello/irapi-go/pkg/api/carclass/get"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+type CarClassDoc struct {
+	Meta database.Meta `bson:"meta,omitempty"`
+	Spec CarClassSpec  `bson:"spec,omitempty"`
+}
+
+type CarClassSpec struct {
+	Data map[string]interface{} `bson:"data,omitempty"`
+}
+
+func generateCarClassDocumentName(carClassID int64) string {
+	return fmt.Sprintf("car_class_%d", carClassID)
+}
+
+func getOrCreateCarClassDocument(db *database.DB, carClassID int64) (*CarClassDoc, error) {
+	var carClass CarClassDoc
+
+	document_name := generateCarClassDocumentName(carClassID)
+
+	err := db.GetOne(CarCollection, CarClassKind, document_name, &carClass)
+	if err != nil {
+		if err == database.ErrNotFound {
+			carClass = CarClassDoc{
+				Meta: database.Meta{
+					Version:   0,
+					CreatedAt: time.Now().UTC(),
+
+					Kind:   CarClassKind,
+					Name:   document_name,
+					Labels: map[string]interface{}{},
+				},
+				Spec: CarClassSpec{},
+			}
+
+			err = db.Create(CarCollection, &carClass)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	return &carClass, nil
+}
+
+func saveCarClassDocument(db *database.DB, carClass *CarClassDoc) error {
+	carClass.Meta.Version += 1
+	return db.Update(CarCollection, CarClassKind, carClass.Meta.Name, carClass.Meta.Version-1, carClass)
+}
+
+// carClassMembership returns the sorted IDs of the classes of every car.
+func carClassMembership(carClasses get.CarclassGetResponse) map[int64][]int64 {
+	membership := make(map[int64][]int64)
+
+	for _, carClass := range carClasses {
+		for _, car := range carClass.CarsInClass {
+			if !slices.Contains(membership[car.CarID], carClass.CarClassID) {
+				membership[car.CarID] = append(membership[car.CarID], carClass.CarClassID)
+			}
+		}
+	}
+
+	for _, carClassIDs := range membership {
+		slices.Sort(carClassIDs)
+	}
+
+	return membership
+}
+
+// syncCarClassMembership updates the car classes of the car documents, also
+// removing the classes from the cars no longer in them.
+func syncCarClassMembership(db *database.DB, carClasses get.CarclassGetResponse) (int, error) {
+	membership := carClassMembership(carClasses)
+
+	var cars []CarDoc
+	err := db.List(CarCollection, CarKind, &cars)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list car documents: %w", err)
+	}
+
+	existing := make(map[string]bool, len(cars))
+	updated := 0
+
+	for i := range cars {
+		car := &cars[i]
+		existing[car.Meta.Name] = true
+
+		carID, ok := car.Meta.Labels["car_id"].(int64)
+		if !ok {
+			log.Printf("Skipping car document without car_id label: %s", car.Meta.Name)
+			continue
+		}
+
+		if slices.Equal(car.Status.CarClassIDs, membership[carID]) {
+			continue
+		}
+
+		car.Status.CarClassIDs = membership[carID]
+		err = saveCarDocument(db, car)
+		if err != nil {
+			return updated, fmt.Errorf("failed to save car document: %w", err)
+		}
+		updated++
+	}
+
+	// Cars not stored yet, their data comes with the cars processor
+	for carID, carClassIDs := range membership {
+		if existing[generateCarDocumentName(carID)] {
+			continue
+		}
+
+		car, err := getOrCreateCarDocument(db, carID)
+		if err != nil {
+			return updated, fmt.Errorf("failed to get or create car document: %w", err)
+		}
+
+		car.Meta.Labels["car_id"] = carID
+		car.Status.CarClassIDs = carClassIDs
+
+		err = saveCarDocument(db, car)
+		if err != nil {
+			return updated, fmt.Errorf("failed to save car document: %w", err)
+		}
+		updated++
+	}
+
+	return updated, nil
+}
+
+func (p *Processor) processCarClasses(ctx context.Context, msgData *bus.ApiResponse) error {
+	var err error
+
+	db := p.DB
+
+	body := []byte(msgData.Body)
+
+	// Convert to the IRacing's API response
+	var iRacingCarClasses get.CarclassGetResponse
+	err = json.Unmarshal(body, &iRacingCarClasses)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body: %w", err))
+	}
+
+	var carClassesMapData []map[string]interface{}
+	err = json.Unmarshal(body, &carClassesMapData)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body to map: %w", err))
+	}
+
+	for i, iRacingCarClass := range iRacingCarClasses {
+		carClass, err := getOrCreateCarClassDocument(db, iRacingCarClass.CarClassID)
+		if err != nil {
+			return fmt.Errorf("failed to get or create car class document: %w", err)
+		}
+
+		// Update the car class document data and labels
+		carIDs := make([]int64, len(iRacingCarClass.CarsInClass))
+		for j, car := range iRacingCarClass.CarsInClass {
+			carIDs[j] = car.CarID
+		}
+
+		carClass.Meta.Labels["car_class_id"] = iRacingCarClass.CarClassID
+		carClass.Meta.Labels["car_ids"] = carIDs
+		carClass.Spec.Data = carClassesMapData[i]
+
+		err = saveCarClassDocument(db, carClass)
+		if err != nil {
+			return fmt.Errorf("failed to save car class document: %w", err)
+		}
+	}
+
+	log.Printf("[%s] Successfully saved %d car classes", msgData.Envelope, len(iRacingCarClasses))
+
+	// Keep the classes of the cars in sync
+	updated, err := syncCarClassMembership(db, iRacingCarClasses)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[%s] Updated the car classes of %d cars", msgData.Envelope, updated)
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/riccardotornesello/irapi-go/pkg/api/car/get"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+type CarDoc struct {
+	Meta   database.Meta `bson:"meta,omitempty"`
+	Spec   CarSpec       `bson:"spec,omitempty"`
+	Status CarStatus     `bson:"status,omitempty"`
+}
+
+type CarSpec struct {
+	Data map[string]interface{} `bson:"data,omitempty"`
+}
+
+type CarStatus struct {
+	// Sorted IDs of the car classes the car belongs to, kept in sync by the car classes processor
+	CarClassIDs []int64 `bson:"car_class_ids,omitempty"`
+}
+
+func generateCarDocumentName(carID int64) string {
+	return fmt.Sprintf("car_%d", carID)
+}
+
+func getOrCreateCarDocument(db *database.DB, carID int64) (*CarDoc, error) {
+	var car CarDoc
+
+	document_name := generateCarDocumentName(carID)
+
+	err := db.GetOne(CarCollection, CarKind, document_name, &car)
+	if err != nil {
+		if err == database.ErrNotFound {
+			car = CarDoc{
+				Meta: database.Meta{
+					Version:   0,
+					CreatedAt: time.Now().UTC(),
+
+					Kind:   CarKind,
+					Name:   document_name,
+					Labels: map[string]interface{}{},
+				},
+				Spec: CarSpec{},
+			}
+
+			err = db.Create(CarCollection, &car)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	return &car, nil
+}
+
+func saveCarDocument(db *database.DB, car *CarDoc) error {
+	car.Meta.Version += 1
+	return db.Update(CarCollection, CarKind, car.Meta.Name, car.Meta.Version-1, car)
+}
+
+func (p *Processor) processCars(ctx context.Context, msgData *bus.ApiResponse) error {
+	var err error
+
+	db := p.DB
+
+	body := []byte(msgData.Body)
+
+	// Convert to the IRacing's API response
+	var iRacingCars get.CarGetResponse
+	err = json.Unmarshal(body, &iRacingCars)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body: %w", err))
+	}
+
+	var carsMapData []map[string]interface{}
+	err = json.Unmarshal(body, &carsMapData)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body to map: %w", err))
+	}
+
+	for i, iRacingCar := range iRacingCars {
+		car, err := getOrCreateCarDocument(db, iRacingCar.CarID)
+		if err != nil {
+			return fmt.Errorf("failed to get or create car document: %w", err)
+		}
+
+		// Update the car document data and labels, the car classes are left to their processor
+		car.Meta.Labels["car_id"] = iRacingCar.CarID
+		car.Spec.Data = carsMapData[i]
+
+		err = saveCarDocument(db, car)
+		if err != nil {
+			return fmt.Errorf("failed to save car document: %w", err)
+		}
+	}
+
+	log.Printf("[%s] Successfully saved %d cars", msgData.Envelope, len(iRacingCars))
+
+	return nil
+}
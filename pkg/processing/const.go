@@ -1,10 +1,48 @@
 package processing
 
+import "time"
+
+const (
+	// Sessions launched this recently can still have incomplete results
+	RecentSessionWindow = 6 * time.Hour
+
+	// Delay of the follow-up fetch of the results of a recent session
+	ResultsRefetchDelay = 30 * time.Minute
+
+	// Previous standings kept in a standings document
+	StandingsHistoryLimit = 50
+
+	// Drivers refreshed by a single member request
+	DriverRefreshBatchSize = 50
+)
+
 const (
 	SeasonCollection = "seasons"
 	SeasonKind       = "iracing_league_season"
+	StandingsKind    = "iracing_league_season_standings"
 
 	SessionCollection = "sessions"
 	SessionKind       = "iracing_session"
 	LapsKind          = "iracing_laps"
 )
+
+const (
+	CarCollection = "cars"
+	CarKind       = "iracing_car"
+	CarClassKind  = "iracing_car_class"
+)
+
+const (
+	TrackCollection = "tracks"
+	TrackKind       = "iracing_track"
+)
+
+const (
+	DriverCollection = "drivers"
+	DriverKind       = "iracing_driver"
+)
+
+const (
+	LeagueCollection = "leagues"
+	LeagueKind       = "iracing_league"
+)
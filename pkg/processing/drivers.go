@@ -0,0 +1,263 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	memberget "github.com/riccardotornesello/irapi-go/pkg/api/member/get"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+type DriverDoc struct {
+	Meta   database.Meta `bson:"meta,omitempty"`
+	Spec   DriverSpec    `bson:"spec,omitempty"`
+	Status DriverStatus  `bson:"status,omitempty"`
+}
+
+type DriverSpec struct {
+	DisplayName string `bson:"display_name,omitempty"`
+
+	// iRacing replaced the clubs with the flairs, this is the name of the flair
+	Club string `bson:"club,omitempty"`
+
+	Licenses []DriverLicense `bson:"licenses,omitempty"`
+
+	// iRating by license category, e.g. sports_car
+	IRatings map[string]int64 `bson:"iratings,omitempty"`
+
+	// Member info as last sent by iRacing
+	Data map[string]interface{} `bson:"data,omitempty"`
+}
+
+type DriverLicense struct {
+	Category     string  `bson:"category"`
+	CategoryID   int64   `bson:"category_id"`
+	LicenseLevel int64   `bson:"license_level"`
+	GroupName    string  `bson:"group_name"`
+	SafetyRating float64 `bson:"safety_rating"`
+	Irating      *int64  `bson:"irating,omitempty"`
+	TtRating     int64   `bson:"tt_rating"`
+}
+
+type DriverStatus struct {
+	// When the driver was last refreshed from iRacing
+	RefreshedAt *time.Time `bson:"refreshed_at,omitempty"`
+}
+
+// ParseRefreshWindow parses how long a driver is not requested again after
+// being refreshed, e.g. 168h. An empty string returns zero, which disables the
+// driver requests.
+func ParseRefreshWindow(window string) (time.Duration, error) {
+	if window == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, fmt.Errorf("invalid refresh window '%s': %w", window, err)
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("invalid refresh window '%s': negative duration", window)
+	}
+
+	return duration, nil
+}
+
+func generateDriverDocumentName(custID int64) string {
+	return fmt.Sprintf("driver_%d", custID)
+}
+
+func getOrCreateDriverDocument(db *database.DB, custID int64) (*DriverDoc, error) {
+	var driver DriverDoc
+
+	document_name := generateDriverDocumentName(custID)
+
+	err := db.GetOne(DriverCollection, DriverKind, document_name, &driver)
+	if err != nil {
+		if err == database.ErrNotFound {
+			driver = DriverDoc{
+				Meta: database.Meta{
+					Version:   0,
+					CreatedAt: time.Now().UTC(),
+
+					Kind:   DriverKind,
+					Name:   document_name,
+					Labels: map[string]interface{}{},
+				},
+				Spec: DriverSpec{},
+			}
+
+			err = db.Create(DriverCollection, &driver)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	return &driver, nil
+}
+
+func saveDriverDocument(db *database.DB, driver *DriverDoc) error {
+	driver.Meta.Version += 1
+	return db.Update(DriverCollection, DriverKind, driver.Meta.Name, driver.Meta.Version-1, driver)
+}
+
+// setDriverLicenses replaces the licenses of the driver and its iRating by category.
+func setDriverLicenses(driver *DriverDoc, licenses []DriverLicense) {
+	driver.Spec.Licenses = licenses
+	driver.Spec.IRatings = make(map[string]int64)
+
+	for _, license := range licenses {
+		if license.Irating != nil {
+			driver.Spec.IRatings[license.Category] = *license.Irating
+		}
+	}
+}
+
+func (p *Processor) processMembers(ctx context.Context, msgData *bus.ApiResponse) error {
+	var err error
+
+	db := p.DB
+
+	body := []byte(msgData.Body)
+
+	// Convert to the IRacing's API response
+	var iRacingMembers memberget.MemberGetResponse
+	err = json.Unmarshal(body, &iRacingMembers)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body: %w", err))
+	}
+
+	var membersMapData struct {
+		Members []map[string]interface{} `json:"members"`
+	}
+	err = json.Unmarshal(body, &membersMapData)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body to map: %w", err))
+	}
+
+	now := time.Now().UTC()
+
+	for i, member := range iRacingMembers.Members {
+		driver, err := getOrCreateDriverDocument(db, member.CustID)
+		if err != nil {
+			return fmt.Errorf("failed to get or create driver document: %w", err)
+		}
+
+		driver.Meta.Labels["cust_id"] = member.CustID
+
+		driver.Spec.DisplayName = member.DisplayName
+		driver.Spec.Club = member.FlairName
+		driver.Spec.Data = membersMapData.Members[i]
+
+		// The licenses are only sent when requested
+		if member.Licenses != nil {
+			licenses := make([]DriverLicense, len(member.Licenses))
+			for j, license := range member.Licenses {
+				licenses[j] = DriverLicense{
+					Category:     license.Category,
+					CategoryID:   license.CategoryID,
+					LicenseLevel: license.LicenseLevel,
+					GroupName:    license.GroupName,
+					SafetyRating: license.SafetyRating,
+					Irating:      license.Irating,
+					TtRating:     license.TtRating,
+				}
+			}
+			setDriverLicenses(driver, licenses)
+
+			// Without the licenses the driver is not up to date
+			driver.Status.RefreshedAt = &now
+		}
+
+		err = saveDriverDocument(db, driver)
+		if err != nil {
+			return fmt.Errorf("failed to save driver document: %w", err)
+		}
+	}
+
+	log.Printf("[%s] Successfully saved %d drivers", msgData.Envelope, len(iRacingMembers.Members))
+
+	return nil
+}
+
+// staleDrivers returns the drivers not refreshed within the refresh window.
+func (p *Processor) staleDrivers(custIDs []int64) ([]int64, error) {
+	names := make([]string, len(custIDs))
+	for i, custID := range custIDs {
+		names[i] = generateDriverDocumentName(custID)
+	}
+
+	var drivers []DriverDoc
+	err := p.DB.ListByNames(DriverCollection, DriverKind, names, &drivers)
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := time.Now().UTC().Add(-p.DriverRefreshWindow)
+
+	fresh := make(map[string]bool, len(drivers))
+	for _, driver := range drivers {
+		if driver.Status.RefreshedAt != nil && driver.Status.RefreshedAt.After(threshold) {
+			fresh[driver.Meta.Name] = true
+		}
+	}
+
+	var stale []int64
+	for i, custID := range custIDs {
+		if !fresh[names[i]] {
+			stale = append(stale, custID)
+		}
+	}
+
+	return stale, nil
+}
+
+// driverRefreshRequests returns the member requests, with their licenses, of
+// the drivers not refreshed within the refresh window, in batches of
+// DriverRefreshBatchSize. None when the window is zero or the fan-out is
+// disabled.
+func (p *Processor) driverRefreshRequests(custIDs []int64) ([]bus.ApiRequest, error) {
+	if p.NoFanOut || p.DriverRefreshWindow <= 0 || len(custIDs) == 0 {
+		return nil, nil
+	}
+
+	stale, err := p.staleDrivers(custIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sorted, so the same drivers make the same request
+	slices.Sort(stale)
+
+	// The drivers should not hold back the results and laps
+	var apiRequests []bus.ApiRequest
+	for batch := range slices.Chunk(stale, DriverRefreshBatchSize) {
+		ids := make([]string, len(batch))
+		for i, custID := range batch {
+			ids[i] = fmt.Sprintf("%d", custID)
+		}
+
+		apiRequest := bus.ApiRequest{
+			Endpoint: "/data/member/get",
+			Params: map[string]string{
+				"cust_ids":         strings.Join(ids, ","),
+				"include_licenses": "true",
+			},
+		}
+		apiRequest.Priority = bus.PriorityLow
+
+		apiRequests = append(apiRequests, apiRequest)
+	}
+
+	return apiRequests, nil
+}
@@ -1,6 +1,7 @@
 package processing
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -9,6 +10,7 @@ import (
 	"github.com/riccardotornesello/irapi-go/pkg/api/results/lap_data"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
 )
 
 type LapsDoc struct {
@@ -62,9 +64,15 @@ func saveLapsDocument(db *database.DB, laps *LapsDoc) error {
 	return db.Update(SessionCollection, LapsKind, laps.Meta.Name, laps.Meta.Version-1, laps)
 }
 
-func processSessionLaps(db *database.DB, msgData *bus.ApiResponse) error {
+func (p *Processor) processSessionLaps(ctx context.Context, msgData *bus.ApiResponse) error {
 	var err error
 
+	db := p.DB
+
+	if msgData.Chunks == nil {
+		return failure.Permanent(fmt.Errorf("missing chunks in lap data response"))
+	}
+
 	body := []byte(msgData.Body)
 	chunks := []byte(*msgData.Chunks)
 
@@ -72,7 +80,7 @@ func processSessionLaps(db *database.DB, msgData *bus.ApiResponse) error {
 	var iRacingLaps lap_data.ResultsLapDataResponse
 	err = json.Unmarshal(body, &iRacingLaps)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal API response body: %w", err)
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body: %w", err))
 	}
 
 	subsessionID := iRacingLaps.SessionInfo.SubsessionID
@@ -97,13 +105,13 @@ func processSessionLaps(db *database.DB, msgData *bus.ApiResponse) error {
 	var lapMapData map[string]interface{}
 	err = json.Unmarshal(body, &lapMapData)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal API response body to map: %w", err)
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body to map: %w", err))
 	}
 
 	var chunksMapData []map[string]interface{}
 	err = json.Unmarshal(chunks, &chunksMapData)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal API response body to chunks map: %w", err)
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body to chunks map: %w", err))
 	}
 
 	lapsDoc.Spec.Data = lapMapData
@@ -115,7 +123,7 @@ func processSessionLaps(db *database.DB, msgData *bus.ApiResponse) error {
 		return fmt.Errorf("failed to save laps document: %w", err)
 	}
 
-	log.Printf("Successfully saved laps for %d/%d/%d", subsessionID, simsessionNumber, custID)
+	log.Printf("[%s] Successfully saved laps for %d/%d/%d", msgData.Envelope, subsessionID, simsessionNumber, custID)
 
 	return nil
 }
@@ -0,0 +1,233 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	leagueget "github.com/riccardotornesello/irapi-go/pkg/api/league/get"
+	"github.com/riccardotornesello/irapi-go/pkg/api/league/seasons"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+type LeagueDoc struct {
+	Meta database.Meta `bson:"meta,omitempty"`
+	Spec LeagueSpec    `bson:"spec,omitempty"`
+}
+
+type LeagueSpec struct {
+	LeagueName string `bson:"league_name,omitempty"`
+	OwnerID    int64  `bson:"owner_id,omitempty"`
+
+	Data map[string]interface{} `bson:"data,omitempty"`
+}
+
+func generateLeagueDocumentName(leagueID int64) string {
+	return fmt.Sprintf("league_%d", leagueID)
+}
+
+func getOrCreateLeagueDocument(db *database.DB, leagueID int64) (*LeagueDoc, error) {
+	var league LeagueDoc
+
+	document_name := generateLeagueDocumentName(leagueID)
+
+	err := db.GetOne(LeagueCollection, LeagueKind, document_name, &league)
+	if err != nil {
+		if err == database.ErrNotFound {
+			league = LeagueDoc{
+				Meta: database.Meta{
+					Version:   0,
+					CreatedAt: time.Now().UTC(),
+
+					Kind:   LeagueKind,
+					Name:   document_name,
+					Labels: map[string]interface{}{},
+				},
+				Spec: LeagueSpec{},
+			}
+
+			err = db.Create(LeagueCollection, &league)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	return &league, nil
+}
+
+func saveLeagueDocument(db *database.DB, league *LeagueDoc) error {
+	league.Meta.Version += 1
+	return db.Update(LeagueCollection, LeagueKind, league.Meta.Name, league.Meta.Version-1, league)
+}
+
+func (p *Processor) processLeague(ctx context.Context, msgData *bus.ApiResponse) error {
+	var err error
+
+	db := p.DB
+
+	body := []byte(msgData.Body)
+
+	// Convert to the IRacing's API response
+	var iRacingLeague leagueget.LeagueGetResponse
+	err = json.Unmarshal(body, &iRacingLeague)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body: %w", err))
+	}
+
+	leagueID := iRacingLeague.LeagueID
+
+	// Get the league from the database
+	league, err := getOrCreateLeagueDocument(db, leagueID)
+	if err != nil {
+		return fmt.Errorf("failed to get or create league document: %w", err)
+	}
+
+	// Update the league document data and labels
+	league.Meta.Labels["league_id"] = leagueID
+
+	league.Spec.LeagueName = iRacingLeague.LeagueName
+	league.Spec.OwnerID = iRacingLeague.OwnerID
+
+	err = json.Unmarshal(body, &league.Spec.Data)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body to map: %w", err))
+	}
+
+	err = saveLeagueDocument(db, league)
+	if err != nil {
+		return fmt.Errorf("failed to save league document: %w", err)
+	}
+
+	log.Printf("[%s] Successfully saved league ID: %d", msgData.Envelope, leagueID)
+
+	// Send request to discover the seasons of the league
+	published := p.publishRequests(ctx, msgData, []bus.ApiRequest{
+		{
+			Endpoint: "/data/league/seasons",
+			Params: map[string]string{
+				"league_id": fmt.Sprintf("%d", leagueID),
+			},
+		},
+	})
+
+	log.Printf("[%s] Published %d seasons requests for league ID: %d", msgData.Envelope, published, leagueID)
+
+	return nil
+}
+
+func (p *Processor) processLeagueSeasons(ctx context.Context, msgData *bus.ApiResponse) error {
+	var err error
+
+	db := p.DB
+
+	body := []byte(msgData.Body)
+
+	leagueID, err := strconv.ParseInt(msgData.Params["league_id"], 10, 64)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("invalid league_id parameter: %w", err))
+	}
+
+	// Convert to the IRacing's API response
+	var iRacingSeasons seasons.LeagueSeasonsResponse
+	err = json.Unmarshal(body, &iRacingSeasons)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body: %w", err))
+	}
+
+	var seasonsMapData struct {
+		Seasons []map[string]interface{} `json:"seasons"`
+	}
+	err = json.Unmarshal(body, &seasonsMapData)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body to map: %w", err))
+	}
+
+	var apiRequests []bus.ApiRequest
+
+	for i, iRacingSeason := range iRacingSeasons.Seasons {
+		// Get the season from the database, its sessions are left to the season sessions processor
+		season, err := getOrCreateSeasonDocument(db, leagueID, iRacingSeason.SeasonID)
+		if err != nil {
+			return fmt.Errorf("failed to get or create season document: %w", err)
+		}
+
+		active := iRacingSeason.Active
+
+		season.Meta.Labels["league_id"] = leagueID
+		season.Meta.Labels["season_id"] = iRacingSeason.SeasonID
+
+		season.Spec.SeasonName = iRacingSeason.SeasonName
+		season.Spec.Active = &active
+		season.Spec.PointsSystemName = iRacingSeason.PointsSystemName
+		season.Spec.Data = seasonsMapData.Seasons[i]
+
+		err = saveSeasonDocument(db, season)
+		if err != nil {
+			return fmt.Errorf("failed to update season document: %w", err)
+		}
+
+		// Only the active seasons can have new sessions
+		if !active {
+			continue
+		}
+
+		apiRequests = append(apiRequests, bus.ApiRequest{
+			Endpoint: "/data/league/season_sessions",
+			Params: map[string]string{
+				"league_id":    fmt.Sprintf("%d", leagueID),
+				"season_id":    fmt.Sprintf("%d", iRacingSeason.SeasonID),
+				"results_only": "true",
+			},
+		})
+
+		apiRequests = append(apiRequests, seasonStandingsRequests(leagueID, iRacingSeason)...)
+	}
+
+	published := p.publishRequests(ctx, msgData, apiRequests)
+
+	log.Printf("[%s] Saved %d seasons and published %d season sessions and standings requests for league ID: %d", msgData.Envelope, len(iRacingSeasons.Seasons), published, leagueID)
+
+	return nil
+}
+
+// seasonStandingsRequests returns the requests of the standings of every car
+// class scoring driver points in the season, or of the overall standings when
+// there is none.
+func seasonStandingsRequests(leagueID int64, season seasons.Season) []bus.ApiRequest {
+	var carClassIDs []string
+	for _, carClass := range season.DriverPointsCarClasses {
+		carClassIDs = append(carClassIDs, fmt.Sprintf("%d", carClass.CarClassID))
+	}
+	if len(carClassIDs) == 0 {
+		carClassIDs = []string{""}
+	}
+
+	var apiRequests []bus.ApiRequest
+	for _, carClassID := range carClassIDs {
+		apiRequest := bus.ApiRequest{
+			Endpoint: "/data/league/season_standings",
+			Params: map[string]string{
+				"league_id": fmt.Sprintf("%d", leagueID),
+				"season_id": fmt.Sprintf("%d", season.SeasonID),
+			},
+		}
+		if carClassID != "" {
+			apiRequest.Params["car_class_id"] = carClassID
+		}
+
+		// The standings should not hold back the sessions, they are linked whichever comes first
+		apiRequest.Priority = bus.PriorityLow
+
+		apiRequests = append(apiRequests, apiRequest)
+	}
+
+	return apiRequests
+}
@@ -4,36 +4,112 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"time"
 
-	"cloud.google.com/go/pubsub/v2"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ledger"
 )
 
-func MultiplexProcessing(db *database.DB, ctx context.Context, pub *pubsub.Publisher, msgData *bus.ApiResponse) error {
+// Processor stores the API responses and publishes the follow-up requests.
+type Processor struct {
+	DB         *database.DB
+	Publisher  bus.Publisher
+	ClaimCheck *bus.ClaimCheck
+	Ledger     *ledger.Ledger
+
+	// Stores the responses without publishing their follow-up requests
+	NoFanOut bool
+
+	// Does not fetch again the results of the sessions that just finished
+	NoRefetch bool
+
+	// The drivers of a session are requested when not refreshed within
+	// this window, zero disables the requests
+	DriverRefreshWindow time.Duration
+}
+
+func (p *Processor) MultiplexProcessing(ctx context.Context, msgData *bus.ApiResponse) error {
 	var err error
 
+	// Responses published without an envelope start a new crawl
+	msgData.Envelope = msgData.Envelope.Ensure()
+
+	// Load the payloads that were moved out of the message
+	err = p.ClaimCheck.Resolve(ctx, msgData)
+	if err != nil {
+		return fmt.Errorf("failed to resolve API response payload: %w", err)
+	}
+
 	switch msgData.Endpoint {
 	case "/data/results/get":
-		err = processSessionResults(db, msgData, ctx, pub)
+		err = p.processSessionResults(ctx, msgData)
 		if err != nil {
 			return fmt.Errorf("failed to process session results: %w", err)
 		}
 
 	case "/data/results/lap_data":
-		err = processSessionLaps(db, msgData)
+		err = p.processSessionLaps(ctx, msgData)
 		if err != nil {
 			return fmt.Errorf("failed to process session laps: %w", err)
 		}
 
 	case "/data/league/season_sessions":
-		err = processLeagueSeasonSessions(db, msgData, ctx, pub)
+		err = p.processLeagueSeasonSessions(ctx, msgData)
 		if err != nil {
 			return fmt.Errorf("failed to process league season sessions: %w", err)
 		}
 
+	case "/data/league/season_standings":
+		err = p.processLeagueSeasonStandings(ctx, msgData)
+		if err != nil {
+			return fmt.Errorf("failed to process league season standings: %w", err)
+		}
+
+	case "/data/league/get":
+		err = p.processLeague(ctx, msgData)
+		if err != nil {
+			return fmt.Errorf("failed to process league: %w", err)
+		}
+
+	case "/data/league/seasons":
+		err = p.processLeagueSeasons(ctx, msgData)
+		if err != nil {
+			return fmt.Errorf("failed to process league seasons: %w", err)
+		}
+
+	case "/data/car/get":
+		err = p.processCars(ctx, msgData)
+		if err != nil {
+			return fmt.Errorf("failed to process cars: %w", err)
+		}
+
+	case "/data/carclass/get":
+		err = p.processCarClasses(ctx, msgData)
+		if err != nil {
+			return fmt.Errorf("failed to process car classes: %w", err)
+		}
+
+	case "/data/track/get":
+		err = p.processTracks(ctx, msgData)
+		if err != nil {
+			return fmt.Errorf("failed to process tracks: %w", err)
+		}
+
+	case "/data/track/assets":
+		err = p.processTrackAssets(ctx, msgData)
+		if err != nil {
+			return fmt.Errorf("failed to process track assets: %w", err)
+		}
+
+	case "/data/member/get":
+		err = p.processMembers(ctx, msgData)
+		if err != nil {
+			return fmt.Errorf("failed to process members: %w", err)
+		}
+
 	default:
-		log.Printf("Skipping unknown endpoint: %s", msgData.Endpoint)
+		log.Printf("[%s] Skipping unknown endpoint: %s", msgData.Envelope, msgData.Endpoint)
 		return nil
 	}
 
@@ -0,0 +1,88 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+)
+
+// publishRequests publishes the follow-up requests of msgData, skipping the
+// ones already in flight or fetched recently, and returns how many were published.
+func (p *Processor) publishRequests(ctx context.Context, msgData *bus.ApiResponse, requests []bus.ApiRequest) int {
+	if p.NoFanOut {
+		if len(requests) > 0 {
+			log.Printf("[%s] Fan-out disabled, dropping %d requests", msgData.Envelope, len(requests))
+		}
+		return 0
+	}
+
+	var published []bus.ApiRequest
+	var pubsubResults []bus.PublishResult
+	skipped := 0
+
+	for _, apiRequest := range requests {
+		// A forced refresh ignores the responses fetched so far, like a request due now
+		notBefore := apiRequest.NotBefore
+		if apiRequest.ForceRefresh && notBefore == nil {
+			now := time.Now().UTC()
+			notBefore = &now
+		}
+
+		reserved, err := p.Ledger.Reserve(ctx, apiRequest.Endpoint, apiRequest.Params, notBefore)
+		if err != nil {
+			// Better a duplicate request than a missing one
+			log.Printf("[%s] Failed to check request ledger: %v", msgData.Envelope, err)
+		} else if !reserved {
+			skipped++
+			continue
+		}
+
+		// Children inherit the priority of the parent unless set explicitly
+		priority := apiRequest.Priority
+		apiRequest.Envelope = msgData.Envelope.Child()
+		if priority != "" {
+			apiRequest.Priority = priority
+		}
+
+		data, err := json.Marshal(apiRequest)
+		if err != nil {
+			log.Printf("[%s] Failed to marshal %s request: %v", msgData.Envelope, apiRequest.Endpoint, err)
+			continue
+		}
+
+		pubsubResults = append(pubsubResults, p.Publisher.Publish(ctx, &bus.Message{
+			Data: data,
+			Attributes: map[string]string{
+				"endpoint":            apiRequest.Endpoint,
+				bus.PriorityAttribute: bus.NormalizePriority(apiRequest.Priority),
+			},
+		}))
+		published = append(published, apiRequest)
+	}
+
+	// Check results
+	count := 0
+	for i, result := range pubsubResults {
+		_, err := result.Get(ctx)
+		if err != nil {
+			log.Printf("[%s] Failed to publish %s request message: %v", msgData.Envelope, published[i].Endpoint, err)
+
+			err = p.Ledger.Release(ctx, published[i].Endpoint, published[i].Params)
+			if err != nil {
+				log.Printf("[%s] Failed to release request reservation: %v", msgData.Envelope, err)
+			}
+			continue
+		}
+
+		count++
+	}
+
+	if skipped > 0 {
+		log.Printf("[%s] Skipped %d requests already in flight or fresh", msgData.Envelope, skipped)
+	}
+
+	return count
+}
@@ -8,17 +8,27 @@ import (
 	"strconv"
 	"time"
 
-	"cloud.google.com/go/pubsub/v2"
 	"github.com/riccardotornesello/irapi-go/pkg/api/league/season_sessions"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
 )
 
 type SeasonDoc struct {
 	Meta   database.Meta `bson:"meta,omitempty"`
+	Spec   SeasonSpec    `bson:"spec,omitempty"`
 	Status SeasonStatus  `bson:"status,omitempty"`
 }
 
+// SeasonSpec is the metadata of the season, filled by the league seasons processor.
+type SeasonSpec struct {
+	SeasonName       string `bson:"season_name,omitempty"`
+	Active           *bool  `bson:"active,omitempty"`
+	PointsSystemName string `bson:"points_system_name,omitempty"`
+
+	Data map[string]interface{} `bson:"data,omitempty"`
+}
+
 type SeasonStatus struct {
 	ParsedSessions map[string]SeasonStatusSession `bson:"parsed_sessions,omitempty"`
 }
@@ -71,26 +81,45 @@ func saveSeasonDocument(db *database.DB, season *SeasonDoc) error {
 	return db.Update(SeasonCollection, SeasonKind, season.Meta.Name, season.Meta.Version-1, season)
 }
 
-func processLeagueSeasonSessions(db *database.DB, msgData *bus.ApiResponse, ctx context.Context, pub *pubsub.Publisher) error {
+// recentSessions returns the IDs of the sessions launched within RecentSessionWindow.
+func recentSessions(sessions map[string]SeasonStatusSession, now time.Time) []string {
+	var subsessionIDs []string
+
+	for subsessionID, session := range sessions {
+		if session.LaunchAt == nil || session.LaunchAt.After(now) {
+			continue
+		}
+
+		if now.Sub(*session.LaunchAt) <= RecentSessionWindow {
+			subsessionIDs = append(subsessionIDs, subsessionID)
+		}
+	}
+
+	return subsessionIDs
+}
+
+func (p *Processor) processLeagueSeasonSessions(ctx context.Context, msgData *bus.ApiResponse) error {
 	var err error
 
+	db := p.DB
+
 	body := []byte(msgData.Body)
 
 	leagueID, err := strconv.ParseInt(msgData.Params["league_id"], 10, 64)
 	if err != nil {
-		return fmt.Errorf("invalid league_id parameter: %w", err)
+		return failure.Permanent(fmt.Errorf("invalid league_id parameter: %w", err))
 	}
 
 	seasonID, err := strconv.ParseInt(msgData.Params["season_id"], 10, 64)
 	if err != nil {
-		return fmt.Errorf("invalid season_id parameter: %w", err)
+		return failure.Permanent(fmt.Errorf("invalid season_id parameter: %w", err))
 	}
 
 	// Convert to the IRacing's API response
 	var iracingSeasonSessions season_sessions.LeagueSeasonSessionsResponse
 	err = json.Unmarshal(body, &iracingSeasonSessions)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal API response body: %w", err)
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body: %w", err))
 	}
 
 	// Get the season from the database
@@ -112,52 +141,47 @@ func processLeagueSeasonSessions(db *database.DB, msgData *bus.ApiResponse, ctx
 		}
 	}
 
+	// Update the league season with the newly parsed sessions
+	// Convert the sessions to a map for easier storage
+	season.Status.ParsedSessions = make(map[string]SeasonStatusSession)
+	for _, iracingSession := range iracingSeasonSessions.Sessions {
+		season.Status.ParsedSessions[fmt.Sprintf("%d", iracingSession.SubsessionID)] = SeasonStatusSession{
+			LaunchAt: &iracingSession.LaunchAt.Time,
+			TrackID:  &iracingSession.Track.TrackID,
+		}
+	}
+
 	// Send request to parse the sessions
-	var pubsubRequests [][]byte
-	var pubsubResults []*pubsub.PublishResult
+	var apiRequests []bus.ApiRequest
 
 	for _, subsessionID := range missingSubsessionIds {
-		apiRequest := bus.ApiRequest{
+		apiRequests = append(apiRequests, bus.ApiRequest{
 			Endpoint: "/data/results/get",
 			Params: map[string]string{
 				"subsession_id":    subsessionID,
 				"include_licenses": "false",
 			},
-		}
-
-		data, err := json.Marshal(apiRequest)
-		if err != nil {
-			log.Printf("Failed to marshal sessions request: %v", err)
-			continue
-		}
-
-		pubsubRequests = append(pubsubRequests, data)
-	}
-
-	for _, reqData := range pubsubRequests {
-		result := pub.Publish(ctx, &pubsub.Message{
-			Data: reqData,
 		})
-		pubsubResults = append(pubsubResults, result)
 	}
 
-	// Check results
-	for _, result := range pubsubResults {
-		_, err := result.Get(ctx)
-		if err != nil {
-			log.Printf("Failed to publish sessions request message: %v", err)
+	// Fetch again the results of the sessions that just finished, as they can be incomplete
+	if !p.NoRefetch {
+		now := time.Now().UTC()
+		notBefore := now.Add(ResultsRefetchDelay)
+
+		for _, subsessionID := range recentSessions(season.Status.ParsedSessions, now) {
+			apiRequests = append(apiRequests, bus.ApiRequest{
+				Endpoint: "/data/results/get",
+				Params: map[string]string{
+					"subsession_id":    subsessionID,
+					"include_licenses": "false",
+				},
+				NotBefore: &notBefore,
+			})
 		}
 	}
 
-	// Update the league season with the newly parsed sessions
-	// Convert the sessions to a map for easier storage
-	season.Status.ParsedSessions = make(map[string]SeasonStatusSession)
-	for _, iracingSession := range iracingSeasonSessions.Sessions {
-		season.Status.ParsedSessions[fmt.Sprintf("%d", iracingSession.SubsessionID)] = SeasonStatusSession{
-			LaunchAt: &iracingSession.LaunchAt.Time,
-			TrackID:  &iracingSession.Track.TrackID,
-		}
-	}
+	published := p.publishRequests(ctx, msgData, apiRequests)
 
 	// Update the labels
 	season.Meta.Labels["league_id"] = leagueID
@@ -168,6 +192,6 @@ func processLeagueSeasonSessions(db *database.DB, msgData *bus.ApiResponse, ctx
 		return fmt.Errorf("failed to update season document: %w", err)
 	}
 
-	log.Printf("Published %d sessions requests for league ID: %d", len(pubsubRequests), leagueID)
+	log.Printf("[%s] Published %d sessions requests for league ID: %d", msgData.Envelope, published, leagueID)
 	return nil
 }
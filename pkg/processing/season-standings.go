@@ -0,0 +1,317 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/riccardotornesello/irapi-go/pkg/api/league/season_standings"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+type StandingsDoc struct {
+	Meta   database.Meta   `bson:"meta,omitempty"`
+	Spec   StandingsSpec   `bson:"spec,omitempty"`
+	Status StandingsStatus `bson:"status,omitempty"`
+}
+
+type StandingsSpec struct {
+	Entries []StandingsEntry `bson:"entries,omitempty"`
+
+	Data map[string]interface{} `bson:"data,omitempty"`
+}
+
+type StandingsEntry struct {
+	Position      int64  `bson:"position"`
+	CustID        int64  `bson:"cust_id"`
+	DisplayName   string `bson:"display_name"`
+	CarNumber     string `bson:"car_number,omitempty"`
+	Wins          int64  `bson:"wins"`
+	AverageStart  int64  `bson:"average_start"`
+	AverageFinish int64  `bson:"average_finish"`
+	BasePoints    int64  `bson:"base_points"`
+	Adjustments   int64  `bson:"adjustments"`
+	TotalPoints   int64  `bson:"total_points"`
+}
+
+type StandingsStatus struct {
+	// When the current standings were first fetched
+	SnapshotAt *time.Time `bson:"snapshot_at,omitempty"`
+
+	// Previous standings, the most recent last
+	History []StandingsSnapshot `bson:"history,omitempty"`
+
+	// Subsessions of the season stored in session documents, by cust_id of the drivers who took part
+	Subsessions map[string][]int64 `bson:"subsessions,omitempty"`
+}
+
+type StandingsSnapshot struct {
+	SnapshotAt time.Time        `bson:"snapshot_at"`
+	Entries    []StandingsEntry `bson:"entries"`
+}
+
+// Session document with only the league season and the drivers of the results
+type sessionDriversDoc struct {
+	Meta database.Meta `bson:"meta"`
+	Spec struct {
+		Data struct {
+			LeagueSeasonID int64 `bson:"league_season_id"`
+			SessionResults []struct {
+				Results []struct {
+					CustID int64 `bson:"cust_id"`
+				} `bson:"results"`
+			} `bson:"session_results"`
+		} `bson:"data"`
+	} `bson:"spec"`
+}
+
+func generateStandingsDocumentName(leagueID int64, seasonID int64, carClassID int64) string {
+	return fmt.Sprintf("league_%d_season_%d_class_%d", leagueID, seasonID, carClassID)
+}
+
+func getOrCreateStandingsDocument(db *database.DB, leagueID int64, seasonID int64, carClassID int64) (*StandingsDoc, error) {
+	var standings StandingsDoc
+
+	document_name := generateStandingsDocumentName(leagueID, seasonID, carClassID)
+
+	err := db.GetOne(SeasonCollection, StandingsKind, document_name, &standings)
+	if err != nil {
+		if err == database.ErrNotFound {
+			standings = StandingsDoc{
+				Meta: database.Meta{
+					Version:   0,
+					CreatedAt: time.Now().UTC(),
+
+					Kind:   StandingsKind,
+					Name:   document_name,
+					Labels: map[string]interface{}{},
+				},
+				Spec: StandingsSpec{},
+			}
+
+			err = db.Create(SeasonCollection, &standings)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	return &standings, nil
+}
+
+func saveStandingsDocument(db *database.DB, standings *StandingsDoc) error {
+	standings.Meta.Version += 1
+	return db.Update(SeasonCollection, StandingsKind, standings.Meta.Name, standings.Meta.Version-1, standings)
+}
+
+// seasonSubsessions returns the subsessions of a league season stored in
+// session documents, by cust_id of the drivers who took part. The season_id
+// label of a session is the one of the series, so the league season is matched
+// on the iRacing data, as the sessions stored before the league_season_id
+// label do not have it.
+func seasonSubsessions(db *database.DB, leagueID int64, seasonID int64) (map[string][]int64, error) {
+	var sessions []sessionDriversDoc
+	err := db.ListByLabels(SessionCollection, SessionKind, map[string]interface{}{
+		"league_id": leagueID,
+	}, &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	subsessions := make(map[string][]int64)
+
+	for _, session := range sessions {
+		if session.Spec.Data.LeagueSeasonID != seasonID {
+			continue
+		}
+
+		subsessionID, ok := session.Meta.Labels["subsession_id"].(int64)
+		if !ok {
+			continue
+		}
+
+		for _, simsession := range session.Spec.Data.SessionResults {
+			for _, result := range simsession.Results {
+				custID := fmt.Sprintf("%d", result.CustID)
+				if !slices.Contains(subsessions[custID], subsessionID) {
+					subsessions[custID] = append(subsessions[custID], subsessionID)
+				}
+			}
+		}
+	}
+
+	for _, subsessionIDs := range subsessions {
+		slices.Sort(subsessionIDs)
+	}
+
+	return subsessions, nil
+}
+
+// linkSessionToStandings adds a subsession to the standings of its league
+// season, for the drivers who took part. The standings link the sessions
+// already stored when they are fetched, this covers the sessions stored after
+// them. It returns the number of standings updated.
+func linkSessionToStandings(db *database.DB, leagueID int64, seasonID int64, subsessionID int64, custIDs []int64) (int, error) {
+	var standingsDocs []StandingsDoc
+	err := db.ListByLabels(SeasonCollection, StandingsKind, map[string]interface{}{
+		"league_id": leagueID,
+		"season_id": seasonID,
+	}, &standingsDocs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list standings documents: %w", err)
+	}
+
+	updated := 0
+
+	for i := range standingsDocs {
+		standings := &standingsDocs[i]
+
+		changed := false
+		for _, entry := range standings.Spec.Entries {
+			if !slices.Contains(custIDs, entry.CustID) {
+				continue
+			}
+
+			custID := fmt.Sprintf("%d", entry.CustID)
+			if slices.Contains(standings.Status.Subsessions[custID], subsessionID) {
+				continue
+			}
+
+			if standings.Status.Subsessions == nil {
+				standings.Status.Subsessions = make(map[string][]int64)
+			}
+			standings.Status.Subsessions[custID] = append(standings.Status.Subsessions[custID], subsessionID)
+			slices.Sort(standings.Status.Subsessions[custID])
+			changed = true
+		}
+
+		if !changed {
+			continue
+		}
+
+		err = saveStandingsDocument(db, standings)
+		if err != nil {
+			return updated, fmt.Errorf("failed to save standings document: %w", err)
+		}
+		updated++
+	}
+
+	return updated, nil
+}
+
+func (p *Processor) processLeagueSeasonStandings(ctx context.Context, msgData *bus.ApiResponse) error {
+	var err error
+
+	db := p.DB
+
+	body := []byte(msgData.Body)
+
+	leagueID, err := strconv.ParseInt(msgData.Params["league_id"], 10, 64)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("invalid league_id parameter: %w", err))
+	}
+
+	seasonID, err := strconv.ParseInt(msgData.Params["season_id"], 10, 64)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("invalid season_id parameter: %w", err))
+	}
+
+	// Convert to the IRacing's API response
+	var iRacingStandings season_standings.LeagueSeasonStandingsResponse
+	err = json.Unmarshal(body, &iRacingStandings)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body: %w", err))
+	}
+
+	// Zero for the standings of all the classes
+	carClassID := iRacingStandings.CarClassID
+
+	entries := make([]StandingsEntry, len(iRacingStandings.Standings.DriverStandings))
+	for i, driverStanding := range iRacingStandings.Standings.DriverStandings {
+		entries[i] = StandingsEntry{
+			Position:      driverStanding.Position,
+			CustID:        driverStanding.Driver.CustID,
+			DisplayName:   driverStanding.Driver.DisplayName,
+			Wins:          driverStanding.WINS,
+			AverageStart:  driverStanding.AverageStart,
+			AverageFinish: driverStanding.AverageFinish,
+			BasePoints:    driverStanding.BasePoints,
+			Adjustments:   driverStanding.TotalAdjustments,
+			TotalPoints:   driverStanding.TotalPoints,
+		}
+		if driverStanding.CarNumber != nil {
+			entries[i].CarNumber = *driverStanding.CarNumber
+		}
+	}
+
+	// Link the drivers to the sessions already stored
+	subsessions, err := seasonSubsessions(db, leagueID, seasonID)
+	if err != nil {
+		return fmt.Errorf("failed to list season sessions: %w", err)
+	}
+
+	var custIDs []int64
+	linkedSubsessions := make(map[string][]int64)
+	for _, entry := range entries {
+		custIDs = append(custIDs, entry.CustID)
+
+		custID := fmt.Sprintf("%d", entry.CustID)
+		if subsessionIDs, ok := subsessions[custID]; ok {
+			linkedSubsessions[custID] = subsessionIDs
+		}
+	}
+
+	// Get the standings from the database
+	standings, err := getOrCreateStandingsDocument(db, leagueID, seasonID, carClassID)
+	if err != nil {
+		return fmt.Errorf("failed to get or create standings document: %w", err)
+	}
+
+	// Keep the previous standings when they changed
+	now := time.Now().UTC()
+	if !slices.Equal(standings.Spec.Entries, entries) {
+		if standings.Status.SnapshotAt != nil && len(standings.Spec.Entries) > 0 {
+			standings.Status.History = append(standings.Status.History, StandingsSnapshot{
+				SnapshotAt: *standings.Status.SnapshotAt,
+				Entries:    standings.Spec.Entries,
+			})
+
+			if len(standings.Status.History) > StandingsHistoryLimit {
+				standings.Status.History = standings.Status.History[len(standings.Status.History)-StandingsHistoryLimit:]
+			}
+		}
+
+		standings.Status.SnapshotAt = &now
+	}
+
+	standings.Spec.Entries = entries
+	standings.Status.Subsessions = linkedSubsessions
+
+	err = json.Unmarshal(body, &standings.Spec.Data)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body to map: %w", err))
+	}
+
+	// Update the labels
+	standings.Meta.Labels["league_id"] = leagueID
+	standings.Meta.Labels["season_id"] = seasonID
+	standings.Meta.Labels["car_class_id"] = carClassID
+	standings.Meta.Labels["cust_ids"] = custIDs
+
+	err = saveStandingsDocument(db, standings)
+	if err != nil {
+		return fmt.Errorf("failed to save standings document: %w", err)
+	}
+
+	log.Printf("[%s] Successfully saved standings of %d drivers, %d linked to sessions, for league ID %d season ID %d class ID %d", msgData.Envelope, len(entries), len(linkedSubsessions), leagueID, seasonID, carClassID)
+
+	return nil
+}
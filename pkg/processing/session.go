@@ -5,12 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"slices"
 	"time"
 
-	"cloud.google.com/go/pubsub/v2"
 	"github.com/riccardotornesello/irapi-go/pkg/api/results/get"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
 	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
 )
 
 type SessionDoc struct {
@@ -63,20 +64,22 @@ func saveSessionDocument(db *database.DB, session *SessionDoc) error {
 	return db.Update(SessionCollection, SessionKind, session.Meta.Name, session.Meta.Version-1, session)
 }
 
-func processSessionResults(db *database.DB, msgData *bus.ApiResponse, ctx context.Context, pub *pubsub.Publisher) error {
+func (p *Processor) processSessionResults(ctx context.Context, msgData *bus.ApiResponse) error {
 	var err error
 
+	db := p.DB
+
 	body := []byte(msgData.Body)
 
 	// Convert to the IRacing's API response
 	var iRacingSession get.ResultsGetResponse
 	err = json.Unmarshal(body, &iRacingSession)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal API response body: %w", err)
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body: %w", err))
 	}
 
 	subsessionID := iRacingSession.SubsessionID
-	log.Printf("Processing results for subsession ID: %d", subsessionID)
+	log.Printf("[%s] Processing results for subsession ID: %d", msgData.Envelope, subsessionID)
 
 	// Get the session from the database
 	session, err := getOrCreateSessionDocument(db, subsessionID)
@@ -87,12 +90,13 @@ func processSessionResults(db *database.DB, msgData *bus.ApiResponse, ctx contex
 	// Update the session document data and labels
 	session.Meta.Labels["league_id"] = iRacingSession.LeagueID
 	session.Meta.Labels["season_id"] = iRacingSession.SeasonID
+	session.Meta.Labels["league_season_id"] = iRacingSession.LeagueSeasonID
 	session.Meta.Labels["subsession_id"] = iRacingSession.SubsessionID
 	session.Meta.Labels["track_id"] = iRacingSession.Track.TrackID
 
 	err = json.Unmarshal(body, &session.Spec.Data)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal API response body to map: %w", err)
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body to map: %w", err))
 	}
 
 	// Save to the database
@@ -101,50 +105,55 @@ func processSessionResults(db *database.DB, msgData *bus.ApiResponse, ctx contex
 		return fmt.Errorf("failed to save session document: %w", err)
 	}
 
-	log.Printf("Successfully saved results for subsession ID: %d", subsessionID)
+	log.Printf("[%s] Successfully saved results for subsession ID: %d", msgData.Envelope, subsessionID)
 
-	// Send request to parse lap data
-	var pubsubRequests [][]byte
-	var pubsubResults []*pubsub.PublishResult
+	// Send request to parse lap data, refetched along with the results so the laps match them
+	var apiRequests []bus.ApiRequest
+	var custIDs []int64
 
 	for _, simsession := range iRacingSession.SessionResults {
 		for _, simsessionResult := range simsession.Results {
-			apiRequest := bus.ApiRequest{
+			if simsessionResult.CustID > 0 && !slices.Contains(custIDs, simsessionResult.CustID) {
+				custIDs = append(custIDs, simsessionResult.CustID)
+			}
+
+			apiRequests = append(apiRequests, bus.ApiRequest{
 				Endpoint: "/data/results/lap_data",
 				Params: map[string]string{
 					"subsession_id":     fmt.Sprintf("%d", subsessionID),
 					"simsession_number": fmt.Sprintf("%d", simsession.SimsessionNumber),
 					"cust_id":           fmt.Sprintf("%d", simsessionResult.CustID),
 				},
-				Chunks: true,
-			}
-
-			data, err := json.Marshal(apiRequest)
-			if err != nil {
-				log.Printf("Failed to marshal lap data request: %v", err)
-				continue
-			}
-
-			pubsubRequests = append(pubsubRequests, data)
+				NotBefore:    msgData.NotBefore,
+				ForceRefresh: msgData.ForceRefresh,
+			})
 		}
 	}
 
-	for _, reqData := range pubsubRequests {
-		result := pub.Publish(ctx, &pubsub.Message{
-			Data: reqData,
-		})
-		pubsubResults = append(pubsubResults, result)
-	}
-
-	// Check results
-	for _, result := range pubsubResults {
-		_, err := result.Get(ctx)
+	// Link the session to the standings of its league season already stored
+	if iRacingSession.LeagueID > 0 && iRacingSession.LeagueSeasonID > 0 {
+		linked, err := linkSessionToStandings(db, iRacingSession.LeagueID, iRacingSession.LeagueSeasonID, subsessionID, custIDs)
 		if err != nil {
-			log.Printf("Failed to publish lap data request message: %v", err)
+			// The next standings fetched link it, not worth holding the lap data back
+			log.Printf("[%s] Failed to link subsession ID %d to standings: %v", msgData.Envelope, subsessionID, err)
+		} else {
+			log.Printf("[%s] Linked subsession ID %d to %d standings", msgData.Envelope, subsessionID, linked)
 		}
 	}
 
-	log.Printf("Published %d lap data requests for subsession ID: %d", len(pubsubRequests), subsessionID)
+	published := p.publishRequests(ctx, msgData, apiRequests)
+
+	log.Printf("[%s] Published %d lap data requests for subsession ID: %d", msgData.Envelope, published, subsessionID)
+
+	// Refresh the drivers not refreshed recently
+	driverRequests, err := p.driverRefreshRequests(custIDs)
+	if err != nil {
+		// The drivers are not worth fetching the results again
+		log.Printf("[%s] Failed to look up the drivers of subsession ID %d: %v", msgData.Envelope, subsessionID, err)
+	} else if len(driverRequests) > 0 {
+		published = p.publishRequests(ctx, msgData, driverRequests)
+		log.Printf("[%s] Published %d driver requests for subsession ID: %d", msgData.Envelope, published, subsessionID)
+	}
 
 	return nil
 }
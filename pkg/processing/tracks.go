@@ -0,0 +1,175 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/riccardotornesello/irapi-go/pkg/api/track/assets"
+	"github.com/riccardotornesello/irapi-go/pkg/api/track/get"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+type TrackDoc struct {
+	Meta database.Meta `bson:"meta,omitempty"`
+	Spec TrackSpec     `bson:"spec,omitempty"`
+}
+
+type TrackSpec struct {
+	TrackName  string `bson:"track_name,omitempty"`
+	ConfigName string `bson:"config_name,omitempty"`
+	Category   string `bson:"category,omitempty"`
+
+	// Length of a lap in miles, as sent by iRacing
+	Length  float64 `bson:"length,omitempty"`
+	Corners int64   `bson:"corners,omitempty"`
+
+	Data   map[string]interface{} `bson:"data,omitempty"`
+	Assets map[string]interface{} `bson:"assets,omitempty"`
+}
+
+func generateTrackDocumentName(trackID int64) string {
+	return fmt.Sprintf("track_%d", trackID)
+}
+
+func getOrCreateTrackDocument(db *database.DB, trackID int64) (*TrackDoc, error) {
+	var track TrackDoc
+
+	document_name := generateTrackDocumentName(trackID)
+
+	err := db.GetOne(TrackCollection, TrackKind, document_name, &track)
+	if err != nil {
+		if err == database.ErrNotFound {
+			track = TrackDoc{
+				Meta: database.Meta{
+					Version:   0,
+					CreatedAt: time.Now().UTC(),
+
+					Kind:   TrackKind,
+					Name:   document_name,
+					Labels: map[string]interface{}{},
+				},
+				Spec: TrackSpec{},
+			}
+
+			err = db.Create(TrackCollection, &track)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	return &track, nil
+}
+
+func saveTrackDocument(db *database.DB, track *TrackDoc) error {
+	track.Meta.Version += 1
+	return db.Update(TrackCollection, TrackKind, track.Meta.Name, track.Meta.Version-1, track)
+}
+
+func (p *Processor) processTracks(ctx context.Context, msgData *bus.ApiResponse) error {
+	var err error
+
+	db := p.DB
+
+	body := []byte(msgData.Body)
+
+	// Convert to the IRacing's API response
+	var iRacingTracks get.TrackGetResponse
+	err = json.Unmarshal(body, &iRacingTracks)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body: %w", err))
+	}
+
+	var tracksMapData []map[string]interface{}
+	err = json.Unmarshal(body, &tracksMapData)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body to map: %w", err))
+	}
+
+	// Every configuration of a track has its own track ID
+	for i, iRacingTrack := range iRacingTracks {
+		track, err := getOrCreateTrackDocument(db, iRacingTrack.TrackID)
+		if err != nil {
+			return fmt.Errorf("failed to get or create track document: %w", err)
+		}
+
+		// Update the track document data and labels, the assets are left to their processor
+		track.Meta.Labels["track_id"] = iRacingTrack.TrackID
+		track.Meta.Labels["package_id"] = iRacingTrack.PackageID
+
+		track.Spec.TrackName = iRacingTrack.TrackName
+		track.Spec.ConfigName = ""
+		if iRacingTrack.ConfigName != nil {
+			track.Spec.ConfigName = *iRacingTrack.ConfigName
+		}
+		track.Spec.Category = iRacingTrack.Category
+		track.Spec.Length = iRacingTrack.TrackConfigLength
+		track.Spec.Corners = iRacingTrack.CornersPerLap
+		track.Spec.Data = tracksMapData[i]
+
+		err = saveTrackDocument(db, track)
+		if err != nil {
+			return fmt.Errorf("failed to save track document: %w", err)
+		}
+	}
+
+	log.Printf("[%s] Successfully saved %d tracks", msgData.Envelope, len(iRacingTracks))
+
+	// Send request to fetch the assets, once the tracks they belong to are stored
+	published := p.publishRequests(ctx, msgData, []bus.ApiRequest{
+		{
+			Endpoint: "/data/track/assets",
+		},
+	})
+
+	log.Printf("[%s] Published %d track assets requests", msgData.Envelope, published)
+
+	return nil
+}
+
+func (p *Processor) processTrackAssets(ctx context.Context, msgData *bus.ApiResponse) error {
+	var err error
+
+	db := p.DB
+
+	body := []byte(msgData.Body)
+
+	// Convert to the IRacing's API response
+	var iRacingAssets assets.TrackAssetsResponse
+	err = json.Unmarshal(body, &iRacingAssets)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body: %w", err))
+	}
+
+	var assetsMapData map[string]map[string]interface{}
+	err = json.Unmarshal(body, &assetsMapData)
+	if err != nil {
+		return failure.Permanent(fmt.Errorf("failed to unmarshal API response body to map: %w", err))
+	}
+
+	for key, iRacingTrackAssets := range iRacingAssets {
+		track, err := getOrCreateTrackDocument(db, iRacingTrackAssets.TrackID)
+		if err != nil {
+			return fmt.Errorf("failed to get or create track document: %w", err)
+		}
+
+		track.Meta.Labels["track_id"] = iRacingTrackAssets.TrackID
+		track.Spec.Assets = assetsMapData[key]
+
+		err = saveTrackDocument(db, track)
+		if err != nil {
+			return fmt.Errorf("failed to save track document: %w", err)
+		}
+	}
+
+	log.Printf("[%s] Successfully saved the assets of %d tracks", msgData.Envelope, len(iRacingAssets))
+
+	return nil
+}
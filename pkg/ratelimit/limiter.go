@@ -0,0 +1,173 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+)
+
+const (
+	// Budget and window assumed until iRacing reports its own
+	DefaultLimit  = 240
+	DefaultWindow = time.Minute
+
+	// Requests left in the window that are never spent, as a safety margin
+	DefaultReserve = 10
+
+	// Longest wait for the budget to reset before deferring the request instead
+	DefaultMaxWait = 5 * time.Second
+)
+
+// Limiter is a token bucket shared through MongoDB by every worker instance,
+// kept in sync with the rate-limit headers of the iRacing responses.
+type Limiter struct {
+	db   *database.DB
+	name string
+
+	Limit   int
+	Window  time.Duration
+	Reserve int
+	MaxWait time.Duration
+}
+
+func New(db *database.DB, name string) *Limiter {
+	return &Limiter{
+		db:      db,
+		name:    name,
+		Limit:   DefaultLimit,
+		Window:  DefaultWindow,
+		Reserve: DefaultReserve,
+		MaxWait: DefaultMaxWait,
+	}
+}
+
+func (l *Limiter) collection() *mongo.Collection {
+	return l.db.DB.Collection(Collection)
+}
+
+// EnsureIndexes creates the index used to look up the buckets.
+func (l *Limiter) EnsureIndexes(ctx context.Context) error {
+	_, err := l.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "meta.kind", Value: 1}, {Key: "meta.name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// Acquire takes a request from the budget. When the budget is spent it waits
+// for the reset if it is close, otherwise it returns a rate-limit failure so
+// the request is deferred. A nil Limiter never limits.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	for {
+		taken, resetAt, err := l.take(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to take from the rate limit bucket: %w", err)
+		}
+		if taken {
+			return nil
+		}
+
+		wait := time.Until(resetAt)
+		if wait > l.MaxWait {
+			return failure.RateLimited(resetAt, fmt.Errorf("request budget of '%s' is spent", l.name))
+		}
+
+		select {
+		case <-time.After(max(wait, 100*time.Millisecond)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// take decrements the budget, starting a new window when the current one is
+// over, and returns false with the reset time when the budget is spent.
+func (l *Limiter) take(ctx context.Context) (bool, time.Time, error) {
+	now := time.Now().UTC()
+
+	// Only buckets with budget left can be updated, otherwise the upsert
+	// collides with the existing bucket on the unique index
+	filter := bson.M{
+		"meta.kind": Kind,
+		"meta.name": l.name,
+		"$or": bson.A{
+			bson.M{"status.remaining": bson.M{"$gt": l.Reserve}},
+			bson.M{"status.reset_at": bson.M{"$lte": now}},
+		},
+	}
+
+	expired := bson.M{"$lte": bson.A{"$status.reset_at", now}}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"meta.version":    bson.M{"$ifNull": bson.A{"$meta.version", 0}},
+			"meta.created_at": bson.M{"$ifNull": bson.A{"$meta.created_at", now}},
+			"status.limit":    bson.M{"$ifNull": bson.A{"$status.limit", l.Limit}},
+			"status.remaining": bson.M{"$cond": bson.A{
+				expired,
+				bson.M{"$subtract": bson.A{bson.M{"$ifNull": bson.A{"$status.limit", l.Limit}}, 1}},
+				bson.M{"$subtract": bson.A{"$status.remaining", 1}},
+			}},
+			"status.reset_at":   bson.M{"$cond": bson.A{expired, now.Add(l.Window), "$status.reset_at"}},
+			"status.updated_at": now,
+		}},
+	}
+
+	_, err := l.collection().UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+	if err == nil {
+		return true, time.Time{}, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return false, time.Time{}, err
+	}
+
+	var bucket BucketDoc
+	err = l.collection().FindOne(ctx, bson.M{"meta.kind": Kind, "meta.name": l.name}).Decode(&bucket)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	return false, bucket.Status.ResetAt, nil
+}
+
+// Observe records the budget reported by iRacing. Within the same window the
+// lowest count wins, as other instances may have spent requests meanwhile.
+// A nil Limiter ignores it.
+func (l *Limiter) Observe(ctx context.Context, limit int, remaining int, resetAt time.Time) error {
+	if l == nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	resetAt = resetAt.UTC()
+
+	newWindow := bson.M{"$lt": bson.A{"$status.reset_at", resetAt}}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"meta.version":    bson.M{"$ifNull": bson.A{"$meta.version", 0}},
+			"meta.created_at": bson.M{"$ifNull": bson.A{"$meta.created_at", now}},
+			"status.limit":    limit,
+			"status.remaining": bson.M{"$cond": bson.A{
+				newWindow,
+				remaining,
+				bson.M{"$min": bson.A{"$status.remaining", remaining}},
+			}},
+			"status.reset_at":   bson.M{"$max": bson.A{"$status.reset_at", resetAt}},
+			"status.updated_at": now,
+		}},
+	}
+
+	filter := bson.M{"meta.kind": Kind, "meta.name": l.name}
+	_, err := l.collection().UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+	return err
+}
@@ -0,0 +1,24 @@
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+)
+
+const (
+	Collection = "rate_limits"
+	Kind       = "rate_limit"
+)
+
+type BucketDoc struct {
+	Meta   database.Meta `bson:"meta,omitempty"`
+	Status BucketStatus  `bson:"status,omitempty"`
+}
+
+type BucketStatus struct {
+	Limit     int       `bson:"limit"`
+	Remaining int       `bson:"remaining"`
+	ResetAt   time.Time `bson:"reset_at"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
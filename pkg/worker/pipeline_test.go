@@ -0,0 +1,201 @@
+package worker_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/database"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/deadletter"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/fakeiracing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/iracing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ledger"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/processing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/worker"
+)
+
+const (
+	requestTopicID  = "api-req"
+	responseTopicID = "api-res"
+)
+
+// connect returns a database of its own for the test, dropped when it ends.
+// The test is skipped when MONGODB_URI is not set.
+func connect(t *testing.T) *database.DB {
+	t.Helper()
+
+	dbUri := os.Getenv("MONGODB_URI")
+	if dbUri == "" {
+		t.Skip("MONGODB_URI is not set")
+	}
+
+	db := database.Connect(dbUri, fmt.Sprintf("pipeline_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		db.DB.Drop(context.Background())
+		db.Disconnect()
+	})
+
+	return db
+}
+
+// TestPipeline crawls a league season from the fake iRacing API: its
+// sessions, their results and the chunked laps of every driver. The second
+// session was purged by iRacing, and the tokens are revoked before the crawl
+// so the client has to log in again.
+func TestPipeline(t *testing.T) {
+	db := connect(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	server := fakeiracing.NewServer(nil)
+	defer server.Close()
+
+	err := iracing.RedirectAPI(server.URL)
+	if err != nil {
+		t.Fatalf("failed to redirect the iRacing API: %v", err)
+	}
+
+	dlq := deadletter.NewQueue(db, 0)
+	err = dlq.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("failed to create dead letter indexes: %v", err)
+	}
+
+	requestLedger := ledger.New(db, iracing.Freshness)
+	err = requestLedger.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("failed to create request ledger indexes: %v", err)
+	}
+
+	accountPool := iracing.NewPool([]iracing.Credentials{fakeiracing.Credentials}, db)
+	err = accountPool.EnsureIndexes(ctx)
+	if err != nil {
+		t.Fatalf("failed to create rate limit indexes: %v", err)
+	}
+	err = accountPool.Login()
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+
+	server.RevokeTokens()
+
+	memoryBus := bus.NewMemoryBus()
+
+	requestLanes := make(map[string]bus.Publisher)
+	var requestSubs []bus.Subscriber
+	for _, priority := range bus.Priorities {
+		laneID := bus.PriorityLaneID(requestTopicID, priority)
+		requestLanes[priority] = memoryBus.Publisher(laneID)
+		requestSubs = append(requestSubs, memoryBus.Subscriber(laneID))
+	}
+	requestPub := bus.NewPriorityPublisher(requestLanes)
+
+	handler := &iracing.Handler{
+		Accounts:  accountPool,
+		Publisher: memoryBus.Publisher(responseTopicID),
+		Ledger:    requestLedger,
+	}
+
+	processor := &processing.Processor{
+		DB:        db,
+		Publisher: requestPub,
+		Ledger:    requestLedger,
+	}
+
+	seed, err := json.Marshal(bus.ApiRequest{
+		Envelope: bus.NewEnvelope(),
+		Endpoint: "/data/league/season_sessions",
+		Params: map[string]string{
+			"league_id":    "4403",
+			"season_id":    "111025",
+			"results_only": "true",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal seed request: %v", err)
+	}
+	_, err = requestPub.Publish(ctx, &bus.Message{Data: seed}).Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to publish seed request: %v", err)
+	}
+
+	workersCtx, cancelWorkers := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		worker.ApiPull(workersCtx, bus.NewPrioritySubscriber(requestSubs...), handler, dlq)
+	}()
+	go func() {
+		defer wg.Done()
+		worker.ResponsePull(workersCtx, memoryBus.Subscriber(responseTopicID), processor, dlq)
+	}()
+
+	err = memoryBus.WaitIdle(ctx)
+
+	cancelWorkers()
+	wg.Wait()
+
+	if err != nil {
+		t.Fatalf("pipeline interrupted with %d pending messages: %v", memoryBus.Pending(), err)
+	}
+
+	// The first call was rejected with the revoked token
+	if calls := server.Calls("/data/league/season_sessions"); calls != 2 {
+		t.Errorf("season sessions calls = %d, want 2", calls)
+	}
+
+	var session processing.SessionDoc
+	err = db.GetOne(processing.SessionCollection, processing.SessionKind, "session_70000001", &session)
+	if err != nil {
+		t.Fatalf("failed to get session document: %v", err)
+	}
+	if session.Meta.Labels["league_season_id"] != int64(111025) {
+		t.Errorf("league_season_id label = %v, want 111025", session.Meta.Labels["league_season_id"])
+	}
+
+	for _, custID := range []int64{100001, 100002} {
+		var laps processing.LapsDoc
+		err = db.GetOne(processing.SessionCollection, processing.LapsKind, fmt.Sprintf("laps_70000001_0_%d", custID), &laps)
+		if err != nil {
+			t.Errorf("failed to get laps document of driver %d: %v", custID, err)
+			continue
+		}
+		if len(laps.Spec.Chunks) == 0 {
+			t.Errorf("laps document of driver %d has no laps", custID)
+		}
+	}
+
+	// The purged subsession is dead-lettered and never requested again
+	dead, err := dlq.List(ctx, deadletter.StateDead, 0)
+	if err != nil {
+		t.Fatalf("failed to list dead letters: %v", err)
+	}
+	if len(dead) != 1 {
+		t.Fatalf("dead letters = %d, want 1", len(dead))
+	}
+
+	var deadRequest bus.ApiRequest
+	err = json.Unmarshal([]byte(dead[0].Spec.Data), &deadRequest)
+	if err != nil {
+		t.Fatalf("invalid dead-lettered request: %v", err)
+	}
+	if deadRequest.Endpoint != "/data/results/get" || deadRequest.Params["subsession_id"] != "70000002" {
+		t.Errorf("dead-lettered request = %s %v, want the results of subsession 70000002", deadRequest.Endpoint, deadRequest.Params)
+	}
+
+	failed, err := requestLedger.Failed(ctx, "/data/results/get", map[string]string{"subsession_id": "70000002", "include_licenses": "false"})
+	if err != nil {
+		t.Fatalf("failed to check request ledger: %v", err)
+	}
+	if !failed {
+		t.Error("purged subsession not recorded as failed in the request ledger")
+	}
+}
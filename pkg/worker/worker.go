@@ -0,0 +1,233 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/bus"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/deadletter"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/failure"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/iracing"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/ledger"
+	"github.com/riccardotornesello/sharetelemetry-iracing-scraper/pkg/processing"
+)
+
+const (
+	minRateLimitPause = 5 * time.Second
+	authPause         = 30 * time.Second
+	maxPause          = time.Minute
+)
+
+// ApiPull consumes API requests from sub and hands them to the iRacing handler.
+func ApiPull(ctx context.Context, sub bus.Subscriber, handler *iracing.Handler, dlq *deadletter.Queue) error {
+	return sub.Receive(ctx, func(_ context.Context, msg *bus.Message) {
+		data, err := bus.DecodeMessageData(msg.Data, msg.Attributes)
+		if err != nil {
+			log.Printf("Failed to decode message data: %v", err)
+			fail(ctx, dlq, deadletter.TypeApiRequest, msg, failure.Permanent(err))
+			return
+		}
+
+		var msgData bus.ApiRequest
+		err = json.Unmarshal(data, &msgData)
+		if err != nil {
+			log.Printf("Failed to unmarshal message data: %v", err)
+			fail(ctx, dlq, deadletter.TypeApiRequest, msg, failure.Permanent(err))
+			return
+		}
+
+		err = handler.HandleApiRequest(ctx, &msgData)
+		if errors.Is(err, failure.ErrDeferred) {
+			log.Printf("[%s] Deferring API request: %v", msgData.Envelope, err)
+
+			// Hand the message back when due, or park it when the queue cannot delay it
+			if msg.NackAfter(failure.RetryAfter(err)) {
+				return
+			}
+			if Park(ctx, handler.Ledger, msg, &msgData, err) {
+				msg.Ack()
+				return
+			}
+			msg.Nack()
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] Failed to handle API request: %v", msgData.Envelope, err)
+			fail(ctx, dlq, deadletter.TypeApiRequest, msg, err)
+			return
+		}
+
+		// Acknowledge the message
+		msg.Ack()
+	})
+}
+
+// ResponsePull consumes API responses from sub and hands them to the processor.
+func ResponsePull(ctx context.Context, sub bus.Subscriber, processor *processing.Processor, dlq *deadletter.Queue) error {
+	return sub.Receive(ctx, func(_ context.Context, msg *bus.Message) {
+		data, err := bus.DecodeMessageData(msg.Data, msg.Attributes)
+		if err != nil {
+			log.Printf("Failed to decode message data: %v", err)
+			fail(ctx, dlq, deadletter.TypeApiResponse, msg, failure.Permanent(err))
+			return
+		}
+
+		var msgData bus.ApiResponse
+		err = json.Unmarshal(data, &msgData)
+		if err != nil {
+			log.Printf("Failed to unmarshal message data: %v", err)
+			fail(ctx, dlq, deadletter.TypeApiResponse, msg, failure.Permanent(err))
+			return
+		}
+
+		err = processor.MultiplexProcessing(ctx, &msgData)
+		if err != nil {
+			log.Printf("[%s] Failed to process message: %v", msgData.Envelope, err)
+			fail(ctx, dlq, deadletter.TypeApiResponse, msg, err)
+			return
+		}
+
+		// Acknowledge the message
+		msg.Ack()
+	})
+}
+
+// Fail decides what to do with a message whose processing failed and
+// returns true when it must be acknowledged rather than redelivered.
+//
+// Permanent failures are dead-lettered at once. Rate-limit and authentication
+// failures are retried after a pause, and only dead-lettered once throttled
+// many more times than the other failures. Deferred messages are redelivered,
+// though deferred API requests are better parked with Park first. Anything
+// else is retried until the dead-letter queue gives up on it.
+func Fail(ctx context.Context, dlq *deadletter.Queue, msgType string, msg *bus.Message, cause error) bool {
+	switch failure.Classify(cause) {
+	case failure.ErrDeferred:
+		return false
+
+	case failure.ErrPermanent:
+		if dlq == nil {
+			log.Printf("Dropping message %s after a permanent failure: %v", msg.ID, cause)
+			return true
+		}
+
+		err := dlq.Bury(ctx, msgType, msg, cause)
+		if err != nil {
+			log.Printf("Failed to dead-letter message %s: %v", msg.ID, err)
+			return false
+		}
+		return true
+
+	case failure.ErrRateLimited:
+		if throttled(ctx, dlq, msgType, msg, cause) {
+			return true
+		}
+		pause(ctx, min(max(failure.RetryAfter(cause), minRateLimitPause), maxPause))
+		return false
+
+	case failure.ErrAuth:
+		if throttled(ctx, dlq, msgType, msg, cause) {
+			return true
+		}
+		pause(ctx, authPause)
+		return false
+
+	default:
+		dead, err := dlq.Fail(ctx, msgType, msg, cause)
+		if err != nil {
+			log.Printf("Failed to record failed delivery of message %s: %v", msg.ID, err)
+		}
+		return dead
+	}
+}
+
+// throttled records a rate-limit or authentication failure and returns true
+// when the message was throttled too many times and must be acknowledged.
+// Without a dead-letter queue, the delivery attempt of the transport is used.
+func throttled(ctx context.Context, dlq *deadletter.Queue, msgType string, msg *bus.Message, cause error) bool {
+	if dlq == nil {
+		if msg.DeliveryAttempt != nil && *msg.DeliveryAttempt >= deadletter.DefaultMaxThrottledAttempts {
+			log.Printf("Dropping message %s after %d throttled attempts: %v", msg.ID, *msg.DeliveryAttempt, cause)
+			return true
+		}
+		return false
+	}
+
+	dead, err := dlq.Throttled(ctx, msgType, msg, cause)
+	if err != nil {
+		log.Printf("Failed to record throttled delivery of message %s: %v", msg.ID, err)
+	}
+	return dead
+}
+
+func fail(ctx context.Context, dlq *deadletter.Queue, msgType string, msg *bus.Message, cause error) {
+	if Fail(ctx, dlq, msgType, msg, cause) {
+		msg.Ack()
+		return
+	}
+
+	msg.Nack()
+}
+
+// Park keeps a deferred API request in the ledger until it is due, and
+// returns true when the message must be acknowledged. A request that cannot
+// be parked is redelivered after a pause instead.
+func Park(ctx context.Context, l *ledger.Ledger, msg *bus.Message, msgData *bus.ApiRequest, cause error) bool {
+	notBefore := time.Now().Add(failure.RetryAfter(cause))
+	if msgData.NotBefore != nil {
+		notBefore = *msgData.NotBefore
+	}
+
+	err := l.Park(ctx, msgData.Endpoint, msgData.Params, notBefore, msg.Data, msg.Attributes)
+	if err == nil {
+		log.Printf("[%s] Parked API request until %s", msgData.Envelope, notBefore.UTC().Format(time.RFC3339))
+		return true
+	}
+
+	log.Printf("[%s] Failed to park API request: %v", msgData.Envelope, err)
+	pause(ctx, min(failure.RetryAfter(cause), maxPause))
+	return false
+}
+
+// ReleaseDeferred publishes again the parked API requests that are due and
+// returns how many were published.
+func ReleaseDeferred(ctx context.Context, l *ledger.Ledger, pub bus.Publisher) (int, error) {
+	released := 0
+
+	for {
+		parked, err := l.NextDue(ctx)
+		if err != nil {
+			return released, err
+		}
+		if parked == nil {
+			return released, nil
+		}
+
+		result := pub.Publish(ctx, &bus.Message{
+			Data:       parked.Data,
+			Attributes: parked.Attributes,
+		})
+		_, err = result.Get(ctx)
+		if err != nil {
+			// Keep the request for the next release rather than losing it
+			unclaimErr := l.Unclaim(ctx, parked)
+			if unclaimErr != nil {
+				log.Printf("Failed to park again request %s: %v", parked.Name, unclaimErr)
+			}
+			return released, err
+		}
+
+		released++
+	}
+}
+
+// pause delays the redelivery of a message that failed for reasons outside of its control.
+func pause(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
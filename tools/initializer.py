@@ -10,7 +10,9 @@ os.environ["PUBSUB_EMULATOR_HOST"] = "localhost:8085"
 
 # Define here the structure: { "topic_name": ["subscription_name1", "subscription_name2"], ... }
 SCHEMA = {
+    "api-req-high": ["sub-api-req-high"],
     "api-req": ["sub-api-req"],
+    "api-req-low": ["sub-api-req-low"],
     "api-res": ["sub-api-res"],
 }
 
@@ -14,6 +14,12 @@ DATA = {
     "api-req": [
         # {"endpoint": "/data/results/lap_data", "params": {"subsession_id": "32057182", "simsession_number": "0", "cust_id": "107253"}, "chunks": True},
         # {"endpoint": "/data/results/get", "params": {"subsession_id": "81891896", "include_licenses": "false"}},
+        # {"endpoint": "/data/car/get"},
+        # {"endpoint": "/data/carclass/get"},
+        # {"endpoint": "/data/track/get"},
+        # {"endpoint": "/data/member/profile", "params": {"cust_id": "107253"}},
+        # {"endpoint": "/data/league/get", "params": {"league_id": "4403"}},
+        # {"endpoint": "/data/league/season_standings", "params": {"league_id": "4403", "season_id": "111025", "car_class_id": "2708"}},
         {"endpoint": "/data/league/season_sessions", "params": {"league_id": "4403", "season_id": "0", "results_only": "true"}},
     ]
 }